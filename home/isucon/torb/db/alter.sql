@@ -0,0 +1,12 @@
+ALTER TABLE events ADD COLUMN allocation VARCHAR(32) NOT NULL DEFAULT 'random';
+ALTER TABLE events ADD COLUMN max_per_user INTEGER UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE events ADD COLUMN max_per_rank INTEGER UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE reservations ADD COLUMN checked_in_at DATETIME(6) DEFAULT NULL;
+ALTER TABLE sheets ADD COLUMN venue_id INTEGER UNSIGNED NOT NULL DEFAULT 1, ADD COLUMN active_fg TINYINT(1) NOT NULL DEFAULT 1, DROP KEY rank_num_uniq, ADD UNIQUE KEY venue_id_rank_num_uniq (venue_id, `rank`, num);
+ALTER TABLE events ADD COLUMN venue_id INTEGER UNSIGNED NOT NULL DEFAULT 1;
+ALTER TABLE events ADD COLUMN starts_at DATETIME DEFAULT NULL, ADD COLUMN sales_open_at DATETIME DEFAULT NULL, ADD COLUMN sales_close_at DATETIME DEFAULT NULL;
+ALTER TABLE events ADD COLUMN publish_at DATETIME DEFAULT NULL, ADD COLUMN close_at DATETIME DEFAULT NULL;
+ALTER TABLE events ADD COLUMN description VARCHAR(2048) NOT NULL DEFAULT '';
+ALTER TABLE reservations ADD COLUMN price INTEGER UNSIGNED NOT NULL DEFAULT 0;
+UPDATE reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id SET r.price = e.price + s.price;
+ALTER TABLE reservations ADD COLUMN discount INTEGER UNSIGNED NOT NULL DEFAULT 0, ADD COLUMN promo_code VARCHAR(64) NOT NULL DEFAULT '';
@@ -40,5 +40,84 @@ CREATE TABLE IF NOT EXISTS administrators (
     UNIQUE KEY login_name_uniq (login_name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+CREATE TABLE IF NOT EXISTS reservation_transfers (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    from_user_id   INTEGER UNSIGNED NOT NULL,
+    to_user_id     INTEGER UNSIGNED NOT NULL,
+    transferred_at DATETIME(6)      NOT NULL,
+    KEY reservation_id_idx (reservation_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS sheet_claims (
+    event_id    INTEGER UNSIGNED NOT NULL,
+    sheet_id    INTEGER UNSIGNED NOT NULL,
+    `rank`      VARCHAR(128)     NOT NULL,
+    num         INTEGER UNSIGNED NOT NULL,
+    value       VARCHAR(64)      NOT NULL,
+    PRIMARY KEY (event_id, sheet_id),
+    KEY event_id_rank_idx (event_id, `rank`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS id_blocks (
+    name        VARCHAR(64)     PRIMARY KEY,
+    next_id     BIGINT UNSIGNED NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT INTO id_blocks (name, next_id) VALUES ('reservations', 1);
+
+CREATE TABLE IF NOT EXISTS venues (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    name        VARCHAR(128)     NOT NULL,
+    address     VARCHAR(255)     NOT NULL DEFAULT ''
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS venue_ranks (
+    venue_id    INTEGER UNSIGNED NOT NULL,
+    `rank`      VARCHAR(128)     NOT NULL,
+    price       INTEGER UNSIGNED NOT NULL,
+    position    INTEGER UNSIGNED NOT NULL,
+    `rows`      INTEGER UNSIGNED NOT NULL,
+    `columns`   INTEGER UNSIGNED NOT NULL,
+    PRIMARY KEY (venue_id, `rank`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT INTO venues (id, name) VALUES (1, 'default');
+INSERT INTO venue_ranks (venue_id, `rank`, price, position, `rows`, `columns`) VALUES (1, 'S', 5000, 1, 5, 10), (1, 'A', 3000, 2, 10, 15), (1, 'B', 1000, 3, 15, 20), (1, 'C', 0, 4, 20, 25);
+
+CREATE TABLE IF NOT EXISTS event_transitions (
+    id              INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id        INTEGER UNSIGNED NOT NULL,
+    action          VARCHAR(16)      NOT NULL,
+    scheduled_at    DATETIME         DEFAULT NULL,
+    transitioned_at DATETIME(6)      NOT NULL,
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS pricing_rules (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    `rank`      VARCHAR(128)     NOT NULL DEFAULT '',
+    sold_ratio  INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    before_at   DATETIME         DEFAULT NULL,
+    percent     INTEGER          NOT NULL DEFAULT 0,
+    amount      INTEGER          NOT NULL DEFAULT 0,
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    code        VARCHAR(64)      NOT NULL,
+    kind        VARCHAR(16)      NOT NULL,
+    value       INTEGER UNSIGNED NOT NULL,
+    max_uses    INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    used        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    starts_at   DATETIME         DEFAULT NULL,
+    ends_at     DATETIME         DEFAULT NULL,
+    event_ids   VARCHAR(1024)    NOT NULL DEFAULT '',
+    ranks       VARCHAR(1024)    NOT NULL DEFAULT '',
+    UNIQUE KEY code_uniq (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 alter table reservations add index canceled_at_event_id_sheet_id_reserved_at(canceled_at, event_id , sheet_id, reserved_at);
 --alter table reservations add index event_id_sheet_id_reserved_at_idx(event_id, sheet_id, reserved_at);
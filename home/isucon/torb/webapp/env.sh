@@ -3,3 +3,4 @@ DB_HOST=172.16.177.1
 DB_PORT=3306
 DB_USER=root
 DB_PASS=
+# TICKET_SECRET はticket_secret.shが作るticket_secret.envから読む
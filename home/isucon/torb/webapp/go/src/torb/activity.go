@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+// ReservationActivity は予約かキャンセルが起きたことを表す。Type は reserve か cancel。
+type ReservationActivity struct {
+	Type          string `json:"type"`
+	EventID       int64  `json:"event_id"`
+	ReservationID int64  `json:"reservation_id"`
+	UserID        int64  `json:"user_id"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      int64  `json:"sheet_num"`
+	At            int64  `json:"at"`
+}
+
+var (
+	activityChannel   = "reservation_activity"
+	activityHeartbeat = 30 * time.Second
+)
+
+// publishActivities は予約とキャンセルをredisにpublishして、全appの管理画面のwebsocketに流す。
+func publishActivities(activities []*ReservationActivity) {
+	if !redisEnabled() {
+		return
+	}
+	for _, activity := range activities {
+		b, err := json.Marshal(activity)
+		if err != nil {
+			log.Println("failed to marshal activity:", err)
+			continue
+		}
+		if err := client.Publish(activityChannel, b).Err(); err != nil {
+			log.Println("failed to publish activity:", err)
+		}
+	}
+}
+
+func parseEventIDs(values []string) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, v := range values {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// getAdminStream は選んだイベントの予約とキャンセルをwebsocketで流し続ける。
+// 最初は ?event_id= (複数可) のイベント、あとから {"event_ids": [...]} を送ると選び直せる。
+// イベントを選んでいなければ全イベントを流す。
+func getAdminStream(c echo.Context) error {
+	selected := parseEventIDs(c.QueryParams()["event_id"])
+
+	server := websocket.Server{
+		// 他のサイトから管理者のcookieで繋がれないようにする
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if config.Origin == nil || config.Origin.Host != req.Host {
+				return websocket.ErrBadWebSocketOrigin
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			ch := streams.subscribe(activityChannel)
+			defer streams.unsubscribe(activityChannel, ch)
+
+			done := make(chan struct{})
+			defer close(done)
+			selects := make(chan map[int64]bool)
+			go func() {
+				defer close(selects)
+				for {
+					var req struct {
+						EventIDs []int64 `json:"event_ids"`
+					}
+					if err := websocket.JSON.Receive(ws, &req); err != nil {
+						return
+					}
+					ids := make(map[int64]bool, len(req.EventIDs))
+					for _, id := range req.EventIDs {
+						ids[id] = true
+					}
+					select {
+					case selects <- ids:
+					case <-done:
+						return
+					}
+				}
+			}()
+
+			heartbeat := time.NewTicker(activityHeartbeat)
+			defer heartbeat.Stop()
+			for {
+				select {
+				case ids, ok := <-selects:
+					if !ok {
+						return
+					}
+					selected = ids
+				case payload, ok := <-ch:
+					if !ok {
+						return
+					}
+					var activity ReservationActivity
+					if err := json.Unmarshal([]byte(payload), &activity); err != nil {
+						continue
+					}
+					if len(selected) > 0 && !selected[activity.EventID] {
+						continue
+					}
+					if err := websocket.Message.Send(ws, payload); err != nil {
+						return
+					}
+				case <-heartbeat.C:
+					// nginxに切られないように何か流しておく
+					if err := websocket.JSON.Send(ws, echo.Map{"type": "ping"}); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -5,12 +5,19 @@ import (
 	"errors"
 	"go.opencensus.io/trace"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 )
 
+// events.title と events.description の長さ (文字数)
+const (
+	maxEventTitleLength       = 128
+	maxEventDescriptionLength = 2048
+)
+
 type Administrator struct {
 	ID        int64  `json:"id,omitempty"`
 	Nickname  string `json:"nickname,omitempty"`
@@ -155,18 +162,55 @@ func registerAdminRoutes(e *echo.Echo) {
 	e.POST("/admin/api/events", func(c echo.Context) error {
 		ctx := c.Request().Context()
 		var params struct {
-			Title  string `json:"title"`
-			Public bool   `json:"public"`
-			Price  int    `json:"price"`
+			Title       string `json:"title"`
+			Public      bool   `json:"public"`
+			Price       int    `json:"price"`
+			Description string `json:"description"`
+			Allocation  string `json:"allocation"`
+			MaxPerUser  int    `json:"max_per_user"`
+			MaxPerRank  int    `json:"max_per_rank"`
+			VenueID     int64  `json:"venue_id"`
+
+			StartsAt     int64 `json:"starts_at"`
+			SalesOpenAt  int64 `json:"sales_open_at"`
+			SalesCloseAt int64 `json:"sales_close_at"`
+			PublishAt    int64 `json:"publish_at"`
+			CloseAt      int64 `json:"close_at"`
 		}
 		c.Bind(&params)
+		if utf8.RuneCountInString(params.Title) > maxEventTitleLength {
+			return resError(c, "invalid_title", 400)
+		}
+		if utf8.RuneCountInString(params.Description) > maxEventDescriptionLength {
+			return resError(c, "invalid_description", 400)
+		}
+		if params.StartsAt < 0 || !validateSchedule(params.SalesOpenAt, params.SalesCloseAt) || !validateSchedule(params.PublishAt, params.CloseAt) {
+			return resError(c, "invalid_schedule", 400)
+		}
+		if params.VenueID == 0 {
+			params.VenueID = defaultVenueID
+		}
+		if _, err := getVenue(ctx, params.VenueID); err == sql.ErrNoRows {
+			return resError(c, "invalid_venue", 400)
+		} else if err != nil {
+			return err
+		}
+		if params.Allocation == "" {
+			params.Allocation = defaultAllocation
+		}
+		if !validateAllocation(params.Allocation) {
+			return resError(c, "invalid_allocation", 400)
+		}
+		if params.MaxPerUser < 0 || params.MaxPerRank < 0 {
+			return resError(c, "invalid_limit", 400)
+		}
 
 		tx, err := db.Begin()
 		if err != nil {
 			return err
 		}
 
-		res, err := tx.ExecContext(ctx, "INSERT INTO events (title, public_fg, closed_fg, price) VALUES (?, ?, 0, ?)", params.Title, params.Public, params.Price)
+		res, err := tx.ExecContext(ctx, "INSERT INTO events (title, public_fg, closed_fg, price, description, allocation, max_per_user, max_per_rank, venue_id, starts_at, sales_open_at, sales_close_at, publish_at, close_at) VALUES (?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", params.Title, params.Public, params.Price, params.Description, params.Allocation, params.MaxPerUser, params.MaxPerRank, params.VenueID, timeOrNil(params.StartsAt), timeOrNil(params.SalesOpenAt), timeOrNil(params.SalesCloseAt), timeOrNil(params.PublishAt), timeOrNil(params.CloseAt))
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -208,13 +252,40 @@ func registerAdminRoutes(e *echo.Echo) {
 			return resError(c, "not_found", 404)
 		}
 
+		// 送られなかった項目は今の値のままにする
 		var params struct {
-			Public bool `json:"public"`
-			Closed bool `json:"closed"`
+			Public     *bool  `json:"public"`
+			Closed     *bool  `json:"closed"`
+			Allocation string `json:"allocation"`
+			MaxPerUser *int   `json:"max_per_user"`
+			MaxPerRank *int   `json:"max_per_rank"`
+
+			// 0を送ると未設定に戻す
+			StartsAt     *int64 `json:"starts_at"`
+			SalesOpenAt  *int64 `json:"sales_open_at"`
+			SalesCloseAt *int64 `json:"sales_close_at"`
+			PublishAt    *int64 `json:"publish_at"`
+			CloseAt      *int64 `json:"close_at"`
+
+			Title       *string `json:"title"`
+			Description *string `json:"description"`
+			Price       *int64  `json:"price"`
 		}
 		c.Bind(&params)
-		if params.Closed {
-			params.Public = false
+		if params.Title != nil && (*params.Title == "" || utf8.RuneCountInString(*params.Title) > maxEventTitleLength) {
+			return resError(c, "invalid_title", 400)
+		}
+		if params.Description != nil && utf8.RuneCountInString(*params.Description) > maxEventDescriptionLength {
+			return resError(c, "invalid_description", 400)
+		}
+		if params.Price != nil && *params.Price < 0 {
+			return resError(c, "invalid_price", 400)
+		}
+		if params.Allocation != "" && !validateAllocation(params.Allocation) {
+			return resError(c, "invalid_allocation", 400)
+		}
+		if (params.MaxPerUser != nil && *params.MaxPerUser < 0) || (params.MaxPerRank != nil && *params.MaxPerRank < 0) {
+			return resError(c, "invalid_limit", 400)
 		}
 
 		event, err := getEvent(ctx, eventID, -1)
@@ -225,17 +296,81 @@ func registerAdminRoutes(e *echo.Echo) {
 			return err
 		}
 
+		if params.Public == nil {
+			params.Public = &event.PublicFg
+		}
+		if params.Closed == nil {
+			params.Closed = &event.ClosedFg
+		}
+		public, closed := *params.Public, *params.Closed
+		if closed {
+			public = false
+		}
+
 		if event.ClosedFg {
 			return resError(c, "cannot_edit_closed_event", 400)
-		} else if event.PublicFg && params.Closed {
+		} else if event.PublicFg && closed {
 			return resError(c, "cannot_close_public_event", 400)
 		}
 
+		if params.Allocation == "" {
+			params.Allocation = event.Allocation
+		}
+		if params.MaxPerUser == nil {
+			params.MaxPerUser = &event.MaxPerUser
+		}
+		if params.MaxPerRank == nil {
+			params.MaxPerRank = &event.MaxPerRank
+		}
+		if params.StartsAt == nil {
+			params.StartsAt = &event.StartsAtUnix
+		}
+		if params.SalesOpenAt == nil {
+			params.SalesOpenAt = &event.SalesOpenAtUnix
+		}
+		if params.SalesCloseAt == nil {
+			params.SalesCloseAt = &event.SalesCloseAtUnix
+		}
+		if params.PublishAt == nil {
+			params.PublishAt = &event.PublishAtUnix
+		}
+		if params.CloseAt == nil {
+			params.CloseAt = &event.CloseAtUnix
+		}
+		if *params.StartsAt < 0 || !validateSchedule(*params.SalesOpenAt, *params.SalesCloseAt) || !validateSchedule(*params.PublishAt, *params.CloseAt) {
+			return resError(c, "invalid_schedule", 400)
+		}
+		if params.Title == nil {
+			params.Title = &event.Title
+		}
+		if params.Description == nil {
+			params.Description = &event.Description
+		}
+
 		tx, err := db.Begin()
 		if err != nil {
 			return err
 		}
-		if _, err := tx.ExecContext(ctx, "UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", params.Public, params.Closed, event.ID); err != nil {
+		// 売れた席の価格が変わらないように、予約が1件でもあれば価格は変えられない
+		if params.Price != nil && *params.Price != event.Price {
+			var id int64
+			if err := tx.QueryRowContext(ctx, "SELECT id FROM events WHERE id = ? FOR UPDATE", event.ID).Scan(&id); err != nil {
+				tx.Rollback()
+				return err
+			}
+			var reserved bool
+			if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM reservations WHERE event_id = ?)", event.ID).Scan(&reserved); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if reserved {
+				tx.Rollback()
+				return resError(c, "cannot_change_price", 400)
+			}
+		} else {
+			params.Price = &event.Price
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE events SET title = ?, description = ?, price = ?, public_fg = ?, closed_fg = ?, allocation = ?, max_per_user = ?, max_per_rank = ?, starts_at = ?, sales_open_at = ?, sales_close_at = ?, publish_at = ?, close_at = ? WHERE id = ?", *params.Title, *params.Description, *params.Price, public, closed, params.Allocation, *params.MaxPerUser, *params.MaxPerRank, timeOrNil(*params.StartsAt), timeOrNil(*params.SalesOpenAt), timeOrNil(*params.SalesCloseAt), timeOrNil(*params.PublishAt), timeOrNil(*params.CloseAt), event.ID); err != nil {
 			tx.Rollback()
 			return err
 		}
@@ -250,6 +385,25 @@ func registerAdminRoutes(e *echo.Echo) {
 		c.JSON(200, e)
 		return nil
 	}, adminLoginRequired)
+	e.GET("/admin/api/events/:id/waitlist", getAdminWaitlist, adminLoginRequired, redisRequired)
+	e.GET("/admin/api/events/:id/transitions", getAdminEventTransitions, adminLoginRequired)
+	e.GET("/admin/api/events/:id/pricing_rules", getAdminPricingRules, adminLoginRequired)
+	e.POST("/admin/api/events/:id/pricing_rules", postAdminPricingRule, adminLoginRequired)
+	e.DELETE("/admin/api/events/:id/pricing_rules/:rule_id", deleteAdminPricingRule, adminLoginRequired)
+	e.DELETE("/admin/api/events/:id/waitlist/:rank/:user_id", deleteAdminWaitlist, adminLoginRequired, redisRequired)
+	e.GET("/admin/api/reservations/:id/transfers", getAdminTransfers, adminLoginRequired)
+	e.POST("/admin/api/tickets/actions/check_in", postAdminCheckIn, adminLoginRequired)
+	e.GET("/admin/api/reconcile", getAdminReconcile, adminLoginRequired, redisRequired)
+	e.POST("/admin/api/actions/reconcile", postAdminReconcile, adminLoginRequired)
+	e.GET("/admin/api/stream", getAdminStream, adminLoginRequired, redisRequired)
+	e.GET("/admin/api/venues", getAdminVenues, adminLoginRequired)
+	e.POST("/admin/api/venues", postAdminVenue, adminLoginRequired)
+	e.GET("/admin/api/venues/:id", getAdminVenue, adminLoginRequired)
+	e.POST("/admin/api/venues/:id/actions/edit", postAdminVenueEdit, adminLoginRequired)
+	e.DELETE("/admin/api/venues/:id", deleteAdminVenue, adminLoginRequired)
+	e.GET("/admin/api/promo_codes", getAdminPromoCodes, adminLoginRequired)
+	e.POST("/admin/api/promo_codes", postAdminPromoCode, adminLoginRequired)
+	e.DELETE("/admin/api/promo_codes/:id", deleteAdminPromoCode, adminLoginRequired)
 	e.GET("/admin/api/reports/events/:id/sales", func(c echo.Context) error {
 		ctx := c.Request().Context()
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -262,7 +416,7 @@ func registerAdminRoutes(e *echo.Echo) {
 			return err
 		}
 
-		rows, err := db.QueryContext(ctx, "SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num, s.price AS sheet_price, e.price AS event_price FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.event_id = ? ORDER BY reserved_at ASC FOR UPDATE", event.ID)
+		rows, err := db.QueryContext(ctx, "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, r.price, r.discount, r.promo_code, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id = ? ORDER BY reserved_at ASC FOR UPDATE", event.ID)
 		if err != nil {
 			return err
 		}
@@ -272,7 +426,9 @@ func registerAdminRoutes(e *echo.Echo) {
 		for rows.Next() {
 			var reservation Reservation
 			var sheet Sheet
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.Price); err != nil {
+			var discount int64
+			var promoCode string
+			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &discount, &promoCode, &sheet.Rank, &sheet.Num); err != nil {
 				return err
 			}
 			report := Report{
@@ -282,7 +438,9 @@ func registerAdminRoutes(e *echo.Echo) {
 				Num:           sheet.Num,
 				UserID:        reservation.UserID,
 				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
+				Price:         reservation.Price,
+				Discount:      discount,
+				PromoCode:     promoCode,
 			}
 			if reservation.CanceledAt != nil {
 				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
@@ -293,7 +451,7 @@ func registerAdminRoutes(e *echo.Echo) {
 	}, adminLoginRequired)
 	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
 		ctx := c.Request().Context()
-		rows, err := db.QueryContext(ctx, "select r.*, s.rank as sheet_rank, s.num as sheet_num, s.price as sheet_price, e.id as event_id, e.price as event_price from reservations r inner join sheets s on s.id = r.sheet_id inner join events e on e.id = r.event_id order by reserved_at asc for update")
+		rows, err := db.QueryContext(ctx, "select r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, r.price, r.discount, r.promo_code, s.rank as sheet_rank, s.num as sheet_num from reservations r inner join sheets s on s.id = r.sheet_id order by reserved_at asc for update")
 		if err != nil {
 			return err
 		}
@@ -303,18 +461,21 @@ func registerAdminRoutes(e *echo.Echo) {
 		for rows.Next() {
 			var reservation Reservation
 			var sheet Sheet
-			var event Event
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.ID, &event.Price); err != nil {
+			var discount int64
+			var promoCode string
+			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &discount, &promoCode, &sheet.Rank, &sheet.Num); err != nil {
 				return err
 			}
 			report := Report{
 				ReservationID: reservation.ID,
-				EventID:       event.ID,
+				EventID:       reservation.EventID,
 				Rank:          sheet.Rank,
 				Num:           sheet.Num,
 				UserID:        reservation.UserID,
 				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
+				Price:         reservation.Price,
+				Discount:      discount,
+				PromoCode:     promoCode,
 			}
 			if reservation.CanceledAt != nil {
 				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
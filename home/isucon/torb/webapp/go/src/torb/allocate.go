@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// SheetAllocator は会場のrankの空席からn席を選ぶ。
+// used はすでに使われているNumをstringにしたものをkeyに持つ。
+// n席選べない場合はnより少ない数を返す。
+// redisではclaimSheetsScriptが同じ選び方で空席を選んで確保する。
+type SheetAllocator interface {
+	Allocate(rank *VenueRank, used map[string]string, n int) []Sheet
+}
+
+const defaultAllocation = "random"
+
+var allocators = map[string]SheetAllocator{
+	"random":     randomAllocator{},
+	"lowest":     lowestAllocator{},
+	"contiguous": contiguousAllocator{},
+}
+
+func validateAllocation(name string) bool {
+	_, ok := allocators[name]
+	return ok
+}
+
+func allocatorFor(name string) SheetAllocator {
+	if a, ok := allocators[name]; ok {
+		return a
+	}
+	return allocators[defaultAllocation]
+}
+
+// freeNums はrankの空いているNumを昇順で返す。
+func freeNums(rank *VenueRank, used map[string]string) []int64 {
+	r := make([]int, 0, len(used))
+	for k := range used {
+		n, _ := strconv.Atoi(k)
+		r = append(r, n)
+	}
+	sort.Ints(r)
+
+	q := make([]int64, 0, rank.Num)
+	j := 0
+	for i := int64(1); i <= rank.Num; i++ {
+		for j < len(r) && int64(r[j]) < i {
+			j++
+		}
+		if j < len(r) && i == int64(r[j]) {
+			continue
+		}
+		q = append(q, i)
+	}
+	return q
+}
+
+type randomAllocator struct{}
+
+func (randomAllocator) Allocate(rank *VenueRank, used map[string]string, n int) []Sheet {
+	q := freeNums(rank, used)
+	if n > len(q) {
+		n = len(q)
+	}
+	nums := make([]int64, 0, n)
+	for _, i := range rand.Perm(len(q))[:n] {
+		nums = append(nums, q[i])
+	}
+	return rank.SheetsOf(nums)
+}
+
+type lowestAllocator struct{}
+
+func (lowestAllocator) Allocate(rank *VenueRank, used map[string]string, n int) []Sheet {
+	q := freeNums(rank, used)
+	if n > len(q) {
+		n = len(q)
+	}
+	return rank.SheetsOf(q[:n])
+}
+
+// contiguousAllocator は同じ行で連番の空席が続く区間のうち、n席が収まる最も短い区間の先頭から選ぶ。
+// 収まる区間がなければ長い区間から順に埋めて、なるべく席がばらけないようにする。
+type contiguousAllocator struct{}
+
+// adjacent は席aのすぐ右がbかどうか。行の端の席と次の行の先頭の席は隣り合わない。
+func (r *VenueRank) adjacent(a, b int64) bool {
+	if b != a+1 {
+		return false
+	}
+	return r.Columns <= 0 || (a-1)/r.Columns == (b-1)/r.Columns
+}
+
+func (contiguousAllocator) Allocate(rank *VenueRank, used map[string]string, n int) []Sheet {
+	q := freeNums(rank, used)
+
+	var runs [][]int64
+	for i := 0; i < len(q); {
+		j := i + 1
+		for j < len(q) && rank.adjacent(q[j-1], q[j]) {
+			j++
+		}
+		runs = append(runs, q[i:j])
+		i = j
+	}
+
+	best := -1
+	for i, run := range runs {
+		if len(run) >= n && (best < 0 || len(run) < len(runs[best])) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return rank.SheetsOf(runs[best][:n])
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool { return len(runs[i]) > len(runs[j]) })
+	nums := make([]int64, 0, n)
+	for _, run := range runs {
+		for _, num := range run {
+			if len(nums) == n {
+				break
+			}
+			nums = append(nums, num)
+		}
+	}
+	return rank.SheetsOf(nums)
+}
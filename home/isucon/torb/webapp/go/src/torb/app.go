@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/bgpat/ocsql"
 	"github.com/go-redis/redis"
@@ -30,6 +32,12 @@ func sanitizeEvent(e *Event) *Event {
 	sanitized.Price = 0
 	sanitized.PublicFg = false
 	sanitized.ClosedFg = false
+	sanitized.Allocation = ""
+	sanitized.MaxPerUser = 0
+	sanitized.MaxPerRank = 0
+	sanitized.VenueID = 0
+	sanitized.PublishAtUnix = 0
+	sanitized.CloseAtUnix = 0
 	return &sanitized
 }
 
@@ -42,10 +50,8 @@ func fillinUser(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func validateRank(rank string) bool {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM sheets WHERE `rank` = ?", rank).Scan(&count)
-	return count > 0
+func validateRank(venue *Venue, rank string) bool {
+	return venue.Rank(rank) != nil
 }
 
 type Renderer struct {
@@ -57,11 +63,44 @@ func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 }
 
 var (
-	db     *sql.DB
+	db *sql.DB
+	// client はredisを使わずに起動したときはnil
 	client *redis.Client
 )
 
+// redisEnabled はredisに繋いで起動したかどうか。
+// 仮押さえ、キャンセル待ち、配信などredisにしかない機能はredisなしでは使えない。
+func redisEnabled() bool {
+	return client != nil
+}
+
+// redisRequired はredisなしで起動しているときに、redisを使う機能のリクエストを断る。
+func redisRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !redisEnabled() {
+			return resError(c, "redis_unavailable", 503)
+		}
+		return next(c)
+	}
+}
+
+// tryLock は複数台のappで同時に走らせたくない処理のロックを取る。redisなしなら1台なのでいつでも取れる。
+func tryLock(key string, ttl time.Duration) bool {
+	if !redisEnabled() {
+		return true
+	}
+	ok, err := client.SetNX(key, 1, ttl).Result()
+	return err == nil && ok
+}
+
 func main() {
+	// 署名の鍵がわかるとどの予約のチケットも作れてしまうので、設定されていなければ何もせずに終わる
+	secret := os.Getenv("TICKET_SECRET")
+	if secret == "" {
+		log.Fatal("TICKET_SECRET is not set")
+	}
+	ticketSecret = []byte(secret)
+
 	exporter, err := jaeger.NewExporter(jaeger.Options{
 		Endpoint: "http://isucon-monitor.401.jp:14268",
 		Process: jaeger.Process{
@@ -92,12 +131,49 @@ func main() {
 		log.Fatal(err)
 	}
 
-	client = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	if _, err := client.Ping().Result(); err != nil {
+	// 席の排他をどこで取るか。redis (デフォルト), mysql, memory
+	seatInventory := os.Getenv("SEAT_INVENTORY")
+	// redisのinventoryでなければREDIS_ADDRを設定しない限りredisなしで起動する
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" && (seatInventory == "" || seatInventory == "redis") {
+		redisAddr = "localhost:6379"
+	}
+	if redisAddr != "" {
+		client = redis.NewClient(&redis.Options{
+			Addr: redisAddr,
+		})
+		if _, err := client.Ping().Result(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("starting without redis: holds, waitlists, idempotency keys and live streams are disabled")
+	}
+
+	if inventory, err = newSeatInventory(seatInventory); err != nil {
 		log.Fatal(err)
 	}
+	inventory = &notifyingInventory{SeatInventory: inventory}
+	if redisEnabled() {
+		go watchVenues()
+		go runBroker()
+	}
+
+	reservationIDs = newBlockIDAllocator(db, "reservations", 100)
+
+	if d := os.Getenv("HOLD_DURATION"); d != "" {
+		if holdDuration, err = time.ParseDuration(d); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if redisEnabled() {
+		go sweepHolds()
+	}
+
+	if _, err := reconcile(context.Background(), true); err != nil {
+		log.Println("failed to reconcile:", err)
+	}
+	go reconcileLoop()
+	go scheduleLoop()
 
 	e := echo.New()
 	funcs := template.FuncMap{
@@ -129,15 +205,17 @@ type Report struct {
 	SoldAt        string
 	CanceledAt    string
 	Price         int64
+	Discount      int64
+	PromoCode     string
 }
 
 func renderReportCSV(c echo.Context, reports []Report) error {
 	sort.Slice(reports, func(i, j int) bool { return strings.Compare(reports[i].SoldAt, reports[j].SoldAt) < 0 })
 
-	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
+	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at,discount,promo_code\n")
 	for _, v := range reports {
-		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
-			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
+		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s,%d,%s\n",
+			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt, v.Discount, v.PromoCode))
 	}
 
 	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
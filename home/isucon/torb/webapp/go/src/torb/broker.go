@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// streamBuffer はstreamの1クライアントに溜めておけるメッセージの数。
+// これを超えるほど読むのが遅いクライアントは切って、繋ぎ直してもらう。
+const streamBuffer = 64
+
+// broker はappごとに1本だけredisのpub/subに繋ぎ、届いたメッセージをstreamのクライアントに配る。
+// クライアントごとにsubscribeするとredisの接続数が閲覧者の数だけ増えてしまう。
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan string]bool
+}
+
+var streams = &broker{subs: make(map[string]map[chan string]bool)}
+
+// subscribe はredisのchannelに届いたメッセージを受け取るchanを返す。
+// 使い終わったらunsubscribeする。遅すぎるクライアントのchanはbrokerが閉じる。
+func (b *broker) subscribe(channel string) chan string {
+	ch := make(chan string, streamBuffer)
+	b.mu.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[chan string]bool)
+	}
+	b.subs[channel][ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(channel string, ch chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(channel, ch)
+}
+
+func (b *broker) remove(channel string, ch chan string) {
+	if !b.subs[channel][ch] {
+		return
+	}
+	delete(b.subs[channel], ch)
+	if len(b.subs[channel]) == 0 {
+		delete(b.subs, channel)
+	}
+	close(ch)
+}
+
+func (b *broker) dispatch(channel, payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[channel] {
+		select {
+		case ch <- payload:
+		default:
+			b.remove(channel, ch)
+		}
+	}
+}
+
+// runBroker は席の変化と予約のactivityをsubscribeして配り続ける。redisがあるときだけmainから起動する。
+func runBroker() {
+	pubsub := client.PSubscribe(seatsChannelPrefix + "*")
+	defer pubsub.Close()
+	if err := pubsub.Subscribe(activityChannel); err != nil {
+		log.Fatal(err)
+	}
+	for msg := range pubsub.Channel() {
+		streams.dispatch(msg.Channel, msg.Payload)
+	}
+}
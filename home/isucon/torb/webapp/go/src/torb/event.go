@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"go.opencensus.io/trace"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo"
 )
@@ -16,76 +17,199 @@ type Event struct {
 	ClosedFg bool   `json:"closed,omitempty"`
 	Price    int64  `json:"price,omitempty"`
 
+	Description string `json:"description,omitempty"`
+
+	Allocation string `json:"allocation,omitempty"`
+	MaxPerUser int    `json:"max_per_user,omitempty"`
+	MaxPerRank int    `json:"max_per_rank,omitempty"`
+	VenueID    int64  `json:"venue_id,omitempty"`
+	Venue      *Venue `json:"-"`
+
+	PricingRules []*PricingRule `json:"-"`
+
+	StartsAt         *time.Time `json:"-"`
+	SalesOpenAt      *time.Time `json:"-"`
+	SalesCloseAt     *time.Time `json:"-"`
+	StartsAtUnix     int64      `json:"starts_at,omitempty"`
+	SalesOpenAtUnix  int64      `json:"sales_open_at,omitempty"`
+	SalesCloseAtUnix int64      `json:"sales_close_at,omitempty"`
+
+	PublishAt     *time.Time `json:"-"`
+	CloseAt       *time.Time `json:"-"`
+	PublishAtUnix int64      `json:"publish_at,omitempty"`
+	CloseAtUnix   int64      `json:"close_at,omitempty"`
+
 	Total   int                `json:"total"`
 	Remains int                `json:"remains"`
 	Sheets  map[string]*Sheets `json:"sheets,omitempty"`
 }
 
+const eventColumns = "id, title, public_fg, closed_fg, price, description, allocation, max_per_user, max_per_rank, venue_id, starts_at, sales_open_at, sales_close_at, publish_at, close_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner, event *Event) error {
+	if err := row.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.Description, &event.Allocation, &event.MaxPerUser, &event.MaxPerRank, &event.VenueID, &event.StartsAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.PublishAt, &event.CloseAt); err != nil {
+		return err
+	}
+	event.StartsAtUnix = unixOrZero(event.StartsAt)
+	event.SalesOpenAtUnix = unixOrZero(event.SalesOpenAt)
+	event.SalesCloseAtUnix = unixOrZero(event.SalesCloseAt)
+	event.PublishAtUnix = unixOrZero(event.PublishAt)
+	event.CloseAtUnix = unixOrZero(event.CloseAt)
+	return nil
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// timeOrNil はunix timeをDBに入れる値にする。0なら未設定のNULL。
+func timeOrNil(unix int64) interface{} {
+	if unix == 0 {
+		return nil
+	}
+	return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04:05")
+}
+
+// validateSchedule は開始が終了より前かどうか確かめる。販売期間と公開期間に使う。0は未設定。
+func validateSchedule(openAt, closeAt int64) bool {
+	if openAt < 0 || closeAt < 0 {
+		return false
+	}
+	return openAt == 0 || closeAt == 0 || openAt < closeAt
+}
+
+// salesError は販売期間の外ならエラーコードを返す。予約もキャンセルも販売期間の間だけできる。
+func (e *Event) salesError(now time.Time) string {
+	if e.SalesOpenAt != nil && now.Before(*e.SalesOpenAt) {
+		return "sales_not_started"
+	}
+	if e.SalesCloseAt != nil && !now.Before(*e.SalesCloseAt) {
+		return "sales_closed"
+	}
+	return ""
+}
+
+// getEventRow はeventを1件読んで会場と価格のルールを埋める。
+func getEventRow(ctx context.Context, eventID int64) (*Event, error) {
+	var event Event
+	if err := scanEvent(db.QueryRowContext(ctx, "SELECT "+eventColumns+" FROM events WHERE id = ?", eventID), &event); err != nil {
+		return nil, err
+	}
+	venue, err := getVenue(ctx, event.VenueID)
+	if err != nil {
+		return nil, err
+	}
+	event.Venue = venue
+	if event.PricingRules, err = getPricingRules(ctx, event.ID); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// getEventBase はsheetsや残席を含まないeventの設定だけを返す。
+func getEventBase(ctx context.Context, eventID int64) (*Event, error) {
+	return getEventRow(ctx, eventID)
+}
+
 func getEventsRoot(ctx context.Context) ([]*Event, error) {
-	rows1, err := db.QueryContext(ctx, "SELECT id, title, price FROM events WHERE public_fg = 1 ORDER BY id ASC")
+	rows1, err := db.QueryContext(ctx, "SELECT "+eventColumns+" FROM events WHERE public_fg = 1 ORDER BY id ASC")
 	if err != nil {
 		return nil, err
 	}
 	defer rows1.Close()
 
-	memo := *CreateRemains(ctx)
+	rules, err := getAllPricingRules(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	var events []*Event
+	var eventIDs []int64
 	for rows1.Next() {
 		var event Event
 
-		if err := rows1.Scan(&event.ID, &event.Title, &event.Price); err != nil {
+		if err := scanEvent(rows1, &event); err != nil {
 			return nil, err
 		}
-
-		event.Sheets = CreateSheets(event, memo)
-		event.Total = 1000
-		event.Remains = 1000 - memo[event.ID][4]
+		if event.Venue, err = getVenue(ctx, event.VenueID); err != nil {
+			return nil, err
+		}
+		event.PricingRules = rules[event.ID]
 
 		events = append(events, &event)
+		eventIDs = append(eventIDs, event.ID)
+	}
+	if err := rows1.Err(); err != nil {
+		return nil, err
+	}
+
+	memo, err := CreateRemains(ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		CreateSheets(event, memo)
 	}
 	return events, nil
 }
 
-func CreateSheets(event Event, memo map[int64]map[int]int) map[string]*Sheets {
-	return map[string]*Sheets{
-		"S": &Sheets{Total: 50, Price: 5000 + event.Price, Remains: 50 - memo[event.ID][0]},
-		"A": &Sheets{Total: 150, Price: 3000 + event.Price, Remains: 150 - memo[event.ID][1]},
-		"B": &Sheets{Total: 300, Price: 1000 + event.Price, Remains: 300 - memo[event.ID][2]},
-		"C": &Sheets{Total: 500, Price: 0 + event.Price, Remains: 500 - memo[event.ID][3]},
+// CreateSheets は会場のrankごとの席数、memoの埋まっている席数からeventの残席と価格を埋める。
+func CreateSheets(event *Event, memo map[int64]map[string]int) {
+	now := time.Now()
+	event.Sheets = make(map[string]*Sheets, len(event.Venue.Ranks))
+	event.Total = 0
+	event.Remains = 0
+	for _, r := range event.Venue.Ranks {
+		sold := memo[event.ID][r.Rank]
+		sheets := &Sheets{Total: int(r.Num), Price: event.rankPrice(r, sold, now), Remains: int(r.Num) - sold}
+		event.Sheets[r.Rank] = sheets
+		event.Total += sheets.Total
+		event.Remains += sheets.Remains
 	}
 }
 
-func CreateRemains(ctx context.Context) *map[int64]map[int]int {
-	memo := make(map[int64]map[int]int)
+// CreateRemains はイベントとrankごとの埋まっている席数を返す。仮押さえはeventIDsのイベントの分だけ数える。
+func CreateRemains(ctx context.Context, eventIDs []int64) (map[int64]map[string]int, error) {
+	memo := make(map[int64]map[string]int)
 
-	for i, v := range [][]int{
-		[]int{0, 50},
-		[]int{50, 200},
-		[]int{200, 500},
-		[]int{500, 1000},
-	} {
+	rows, err := db.QueryContext(ctx, "SELECT r.event_id, s.rank, COUNT(1) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.canceled_at IS NULL GROUP BY r.event_id, s.rank")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		rows, err := db.QueryContext(ctx, "SELECT event_id, count(1) FROM reservations WHERE ? < sheet_id AND sheet_id <= ? AND canceled_at IS NULL GROUP BY event_id", v[0], v[1])
-		if err != nil {
-			return nil
+	for rows.Next() {
+		var id int64
+		var rank string
+		var count int
+		if err := rows.Scan(&id, &rank, &count); err != nil {
+			return nil, err
+		}
+		if memo[id] == nil {
+			memo[id] = make(map[string]int)
 		}
-		defer rows.Close()
+		memo[id][rank] = count
+	}
 
-		for rows.Next() {
-			var id int64
-			var count int
-			if err := rows.Scan(&id, &count); err != nil {
-				return nil
-			}
-			if memo[id] == nil {
-				memo[id] = make(map[int]int)
-			}
-			memo[id][i] = count
-			memo[id][4] += count
+	// 仮押さえ中の席も埋まっているものとして数える
+	holds, err := eventHolds(eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, hold := range holds {
+		if memo[hold.EventID] == nil {
+			memo[hold.EventID] = make(map[string]int)
 		}
+		memo[hold.EventID][hold.SheetRank]++
 	}
-	return &memo
+	return memo, nil
 }
 
 func getEvents(ctx context.Context, all bool) ([]*Event, error) {
@@ -97,7 +221,7 @@ func getEvents(ctx context.Context, all bool) ([]*Event, error) {
 	}
 	defer tx.Commit()
 
-	rows, err := tx.QueryContext(ctx, "SELECT * FROM events ORDER BY id ASC")
+	rows, err := tx.QueryContext(ctx, "SELECT "+eventColumns+" FROM events ORDER BY id ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +230,7 @@ func getEvents(ctx context.Context, all bool) ([]*Event, error) {
 	var events []*Event
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+		if err := scanEvent(rows, &event); err != nil {
 			return nil, err
 		}
 		if !all && !event.PublicFg {
@@ -128,62 +252,65 @@ func getEvents(ctx context.Context, all bool) ([]*Event, error) {
 }
 
 func getEventLightSheets(ctx context.Context, eventID, loginUserID int64) (*Event, error) {
-	var event Event
-	if err := db.QueryRowContext(ctx, "SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+	event, err := getEventRow(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	memo, err := CreateRemains(ctx, []int64{event.ID})
+	if err != nil {
 		return nil, err
 	}
-	memo := *CreateRemains(ctx)
-	event.Sheets = CreateSheets(event, memo)
-	event.Total = 1000
-	event.Remains = 1000 - memo[event.ID][4]
+	CreateSheets(event, memo)
 
-	return &event, nil
+	return event, nil
 }
 
 func getEvent(ctx context.Context, eventID, loginUserID int64) (*Event, error) {
-	var event Event
-	if err := db.QueryRowContext(ctx, "SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+	event, err := getEventRow(ctx, eventID)
+	if err != nil {
 		return nil, err
 	}
-	event.Sheets = map[string]*Sheets{
-		"S": &Sheets{},
-		"A": &Sheets{},
-		"B": &Sheets{},
-		"C": &Sheets{},
+	event.Sheets = make(map[string]*Sheets, len(event.Venue.Ranks))
+	for _, r := range event.Venue.Ranks {
+		event.Sheets[r.Rank] = &Sheets{}
 	}
 
-	rows, err := db.QueryContext(ctx, "SELECT * FROM sheets ORDER BY `rank`, num")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	held := heldSheets(event.ID)
 
-	for rows.Next() {
-		var sheet Sheet
-		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			return nil, err
-		}
-		event.Sheets[sheet.Rank].Price = event.Price + sheet.Price
-		event.Total++
-		event.Sheets[sheet.Rank].Total++
-
-		var reservation Reservation
-		err := db.QueryRowContext(ctx, "SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id, sheet_id HAVING reserved_at = MIN(reserved_at)", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt)
-		if err == nil {
-			sheet.Mine = reservation.UserID == loginUserID
-			sheet.Reserved = true
-			sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
-		} else if err == sql.ErrNoRows {
-			event.Remains++
-			event.Sheets[sheet.Rank].Remains++
-		} else {
-			return nil, err
+	for _, r := range event.Venue.Ranks {
+		for _, venueSheet := range r.Sheets {
+			sheet := venueSheet
+			event.Total++
+			event.Sheets[sheet.Rank].Total++
+
+			var reservation Reservation
+			err := db.QueryRowContext(ctx, "SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id, sheet_id HAVING reserved_at = MIN(reserved_at)", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt)
+			if err == nil {
+				sheet.Mine = reservation.UserID == loginUserID
+				sheet.Reserved = true
+				sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
+			} else if err == sql.ErrNoRows && held[sheet.ID] != nil {
+				sheet.Mine = held[sheet.ID].UserID == loginUserID
+				sheet.Reserved = true
+				sheet.Held = true
+			} else if err == sql.ErrNoRows {
+				event.Remains++
+				event.Sheets[sheet.Rank].Remains++
+			} else {
+				return nil, err
+			}
+
+			event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
 		}
+	}
 
-		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
+	now := time.Now()
+	for _, r := range event.Venue.Ranks {
+		sheets := event.Sheets[r.Rank]
+		sheets.Price = event.rankPrice(r, sheets.Total-sheets.Remains, now)
 	}
 
-	return &event, nil
+	return event, nil
 }
 
 func getAPIEvents(c echo.Context) error {
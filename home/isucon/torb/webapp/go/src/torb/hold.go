@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+)
+
+// Hold は購入確定前に一時的に押さえている席。
+// 押さえている間はinventoryの席にholdMarkerを値として入れておき、他の予約から席を守る。
+type Hold struct {
+	ID        int64  `json:"id"`
+	EventID   int64  `json:"event_id"`
+	SheetID   int64  `json:"sheet_id"`
+	SheetRank string `json:"sheet_rank"`
+	SheetNum  int64  `json:"sheet_num"`
+	UserID    int64  `json:"user_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+var (
+	holdIDKey     = "hid"
+	holdsKey      = "holds"
+	holdExpiryKey = "hold_expiry"
+
+	holdDuration      = 10 * time.Minute
+	holdSweepInterval = 10 * time.Second
+)
+
+const holdMarkerPrefix = "hold:"
+
+// eventHoldsKey はイベントの仮押さえを hold id -> Hold で持つハッシュ。holdsKeyと同じものを入れておく
+func eventHoldsKey(eventID int64) string {
+	return fmt.Sprintf("h_%v", eventID)
+}
+
+// userHoldsKey はuserの仮押さえのidのset
+func userHoldsKey(userID int64) string {
+	return fmt.Sprintf("hu_%v", userID)
+}
+
+func (h *Hold) sheet() Sheet {
+	return Sheet{ID: h.SheetID, Rank: h.SheetRank, Num: h.SheetNum}
+}
+
+func holdMarker(holdID int64) string {
+	return holdMarkerPrefix + strconv.FormatInt(holdID, 10)
+}
+
+func isHoldMarker(v string) bool {
+	return strings.HasPrefix(v, holdMarkerPrefix)
+}
+
+func getHold(holdID int64) (*Hold, error) {
+	if !redisEnabled() {
+		return nil, redis.Nil
+	}
+	v, err := client.HGet(holdsKey, strconv.FormatInt(holdID, 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var hold Hold
+	if err := json.Unmarshal([]byte(v), &hold); err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+func decodeHolds(vs []string) ([]*Hold, error) {
+	holds := make([]*Hold, 0, len(vs))
+	for _, v := range vs {
+		var hold Hold
+		if err := json.Unmarshal([]byte(v), &hold); err != nil {
+			return nil, err
+		}
+		holds = append(holds, &hold)
+	}
+	return holds, nil
+}
+
+// getHolds は期限切れでまだ掃除されていないものも含めて全ての仮押さえを返す。reconcileのように全体を見るときだけ使う。
+// redisなしでは仮押さえは作れないので常に空になる。
+func getHolds() ([]*Hold, error) {
+	if !redisEnabled() {
+		return make([]*Hold, 0), nil
+	}
+	vs, err := client.HVals(holdsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeHolds(vs)
+}
+
+// eventHolds はeventIDsのイベントの仮押さえを返す。
+func eventHolds(eventIDs []int64) ([]*Hold, error) {
+	if !redisEnabled() || len(eventIDs) == 0 {
+		return make([]*Hold, 0), nil
+	}
+	cmds := make([]*redis.StringSliceCmd, 0, len(eventIDs))
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, eventID := range eventIDs {
+			cmds = append(cmds, pipe.HVals(eventHoldsKey(eventID)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var vs []string
+	for _, cmd := range cmds {
+		vs = append(vs, cmd.Val()...)
+	}
+	return decodeHolds(vs)
+}
+
+// heldSheets はイベントで仮押さえされている席をsheet idで引けるようにして返す。
+func heldSheets(eventID int64) map[int64]*Hold {
+	held := make(map[int64]*Hold)
+	holds, err := eventHolds([]int64{eventID})
+	if err != nil {
+		log.Println("failed to get holds:", err)
+		return held
+	}
+	for _, hold := range holds {
+		held[hold.SheetID] = hold
+	}
+	return held
+}
+
+// createHold はinventoryで席を押さえ、期限付きの仮押さえを作る。
+func createHold(eventID, userID int64, sheet Sheet) (*Hold, error) {
+	holdID, err := client.Incr(holdIDKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := inventory.ClaimSheet(eventID, sheet, holdMarker(holdID))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errSheetTaken
+	}
+	return saveHold(holdID, eventID, userID, sheet)
+}
+
+func saveHold(holdID, eventID, userID int64, sheet Sheet) (*Hold, error) {
+	hold := &Hold{
+		ID:        holdID,
+		EventID:   eventID,
+		SheetID:   sheet.ID,
+		SheetRank: sheet.Rank,
+		SheetNum:  sheet.Num,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(holdDuration).Unix(),
+	}
+	b, err := json.Marshal(hold)
+	if err != nil {
+		releaseSheets(eventID, []Sheet{sheet})
+		return nil, err
+	}
+	id := strconv.FormatInt(holdID, 10)
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(holdsKey, id, b)
+		pipe.HSet(eventHoldsKey(eventID), id, b)
+		pipe.SAdd(userHoldsKey(userID), id)
+		pipe.ZAdd(holdExpiryKey, redis.Z{Score: float64(hold.ExpiresAt), Member: holdID})
+		return nil
+	})
+	if err != nil {
+		releaseSheets(eventID, []Sheet{sheet})
+		return nil, err
+	}
+	return hold, nil
+}
+
+// removeHold は仮押さえをholdsKeyとイベント、userごとのkeyから消す。
+func removeHold(hold *Hold) {
+	id := strconv.FormatInt(hold.ID, 10)
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(holdsKey, id)
+		pipe.HDel(eventHoldsKey(hold.EventID), id)
+		pipe.SRem(userHoldsKey(hold.UserID), id)
+		return nil
+	})
+	if err != nil {
+		log.Println("failed to remove hold:", err)
+	}
+}
+
+// takeHold は仮押さえを期限の管理から外して呼び出し元のものにする。
+// 他のサーバのsweeperや確定処理がすでに取っていればfalseを返す。
+func takeHold(holdID int64) (bool, error) {
+	n, err := client.ZRem(holdExpiryKey, holdID).Result()
+	return n > 0, err
+}
+
+// releaseHold はtakeHoldで取った仮押さえの席を解放する。
+// キャンセル待ちがいればその人に席を回す。
+func releaseHold(hold *Hold) {
+	removeHold(hold)
+	v, ok, err := inventory.Get(hold.EventID, hold.sheet())
+	if err != nil || !ok || v != holdMarker(hold.ID) {
+		return
+	}
+	if err := freeSheets(hold.EventID, []Sheet{hold.sheet()}); err != nil {
+		log.Println("failed to free held sheet:", err)
+	}
+}
+
+// userHolds はuserの仮押さえを返す。キャンセル待ちから回ってきた席もここに含まれる。
+func userHolds(userID int64) ([]*Hold, error) {
+	if !redisEnabled() {
+		return make([]*Hold, 0), nil
+	}
+	ids, err := client.SMembers(userHoldsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return make([]*Hold, 0), nil
+	}
+	vs, err := client.HMGet(holdsKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	found := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			found = append(found, s)
+		}
+	}
+	return decodeHolds(found)
+}
+
+func sweepHolds() {
+	for range time.Tick(holdSweepInterval) {
+		ids, err := client.ZRangeByScore(holdExpiryKey, redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().Unix(), 10),
+		}).Result()
+		if err != nil {
+			log.Println("failed to sweep holds:", err)
+			continue
+		}
+		for _, id := range ids {
+			holdID, _ := strconv.ParseInt(id, 10, 64)
+			taken, err := takeHold(holdID)
+			if err != nil || !taken {
+				continue
+			}
+			hold, err := getHold(holdID)
+			if err != nil {
+				log.Println("failed to get expired hold:", err)
+				continue
+			}
+			releaseHold(hold)
+		}
+	}
+}
+
+func postHold(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postHold")
+	defer span.End()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank string `json:"sheet_rank"`
+		Num  int64  `json:"sheet_num"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	event, err := getEvent(ctx, eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.PublicFg {
+		return resError(c, "invalid_event", 404)
+	}
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
+	}
+
+	if !validateRank(event.Venue, params.Rank) {
+		return resError(c, "invalid_rank", 400)
+	}
+
+	if err := checkHoldLimit(ctx, event, user.ID, []string{params.Rank}); err == errLimitExceeded {
+		return resError(c, "limit_exceeded", 403)
+	} else if err != nil {
+		return err
+	}
+
+	var hold *Hold
+	if params.Num != 0 {
+		sheet, ok := event.Venue.Rank(params.Rank).Sheet(params.Num)
+		if !ok {
+			return resError(c, "invalid_sheet", 404)
+		}
+		hold, err = createHold(event.ID, user.ID, sheet)
+		if err == errSheetTaken {
+			return resError(c, "sheet_taken", 409)
+		}
+	} else {
+		hold, err = holdAnySheet(event, user.ID, params.Rank)
+		if err == errSoldOut {
+			return resError(c, "sold_out", 409)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(202, hold)
+}
+
+// checkHoldLimit はuserがranksの席を仮押さえしても上限を超えないか確かめる。
+// 仮押さえで上限を超えて席を抱え込めないように、押さえ中の席も予約済みとして数える。
+func checkHoldLimit(ctx context.Context, event *Event, userID int64, ranks []string) error {
+	if event.MaxPerUser == 0 && event.MaxPerRank == 0 {
+		return nil
+	}
+	holds, err := userHolds(userID)
+	if err != nil {
+		return err
+	}
+	for _, h := range holds {
+		if h.EventID == event.ID {
+			ranks = append(ranks, h.SheetRank)
+		}
+	}
+	return checkReservationLimit(ctx, db, event, userID, ranks)
+}
+
+func holdAnySheet(event *Event, userID int64, rank string) (*Hold, error) {
+	holdID, err := client.Incr(holdIDKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sheets, err := inventory.Claim(event.ID, event.Venue, event.Allocation, []string{rank}, holdMarker(holdID))
+	if err != nil {
+		return nil, err
+	}
+	return saveHold(holdID, event.ID, userID, sheets[0])
+}
+
+func holdFromParam(c echo.Context) (*Hold, *User, error) {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil, resError(c, "not_found", 404)
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	hold, err := getHold(holdID)
+	if err == redis.Nil {
+		return nil, nil, resError(c, "hold_not_found", 404)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if hold.UserID != user.ID {
+		return nil, nil, resError(c, "not_permitted", 403)
+	}
+	return hold, user, nil
+}
+
+func postHoldConfirm(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postHoldConfirm")
+	defer span.End()
+	hold, user, err := holdFromParam(c)
+	if hold == nil {
+		return err
+	}
+
+	// 確定する時点の価格で予約するので残席と価格も読む
+	event, err := getEventLightSheets(ctx, hold.EventID, -1)
+	if err != nil {
+		return err
+	}
+	// 仮押さえの後に非公開や終了になったイベントの席は確定できない
+	if !event.PublicFg || event.ClosedFg {
+		return resError(c, "invalid_event", 404)
+	}
+	// 販売期間が終わる直前に取った仮押さえを、終わった後に確定できないようにする
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
+	}
+
+	taken, err := takeHold(hold.ID)
+	if err != nil {
+		return err
+	}
+	if !taken {
+		return resError(c, "hold_expired", 410)
+	}
+	if time.Now().Unix() >= hold.ExpiresAt {
+		releaseHold(hold)
+		return resError(c, "hold_expired", 410)
+	}
+
+	reservation, err := confirmHold(ctx, event, hold, user.ID)
+	if err != nil {
+		releaseHold(hold)
+		if err == errLimitExceeded {
+			return resError(c, "limit_exceeded", 403)
+		} else if err == errSheetRemoved {
+			forgetVenue(event.VenueID)
+			return resError(c, "invalid_sheet", 404)
+		}
+		return err
+	}
+	return c.JSON(202, echo.Map{
+		"id":         reservation.ID,
+		"sheet_rank": reservation.SheetRank,
+		"sheet_num":  reservation.SheetNum,
+	})
+}
+
+// confirmHold はtakeHoldで取った仮押さえを予約にする。
+func confirmHold(ctx context.Context, event *Event, hold *Hold, userID int64) (*Reservation, error) {
+	now := time.Now().UTC()
+	sheet := hold.sheet()
+	reservations, err := insertReservations(ctx, event, userID, []Sheet{sheet}, nil, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := inventory.Set(hold.EventID, sheet, strconv.FormatInt(now.Unix(), 10)); err != nil {
+		log.Println("failed to set confirmed sheet:", err)
+	}
+	removeHold(hold)
+	return reservations[0], nil
+}
+
+func deleteHold(c echo.Context) error {
+	hold, _, err := holdFromParam(c)
+	if hold == nil {
+		return err
+	}
+	taken, err := takeHold(hold.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		releaseHold(hold)
+	}
+	return c.NoContent(204)
+}
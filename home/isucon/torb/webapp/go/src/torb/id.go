@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// IDAllocator はテーブルのidを払い出す。
+type IDAllocator interface {
+	Next(ctx context.Context) (int64, error)
+	// Discard は手元に残っているidを捨てる。idが重複したときやinitializeのあとに呼ぶ。
+	Discard()
+}
+
+var reservationIDs IDAllocator
+
+// blockIDAllocator はid_blocksからsize個ずつidをまとめて借りて、手元で順に払い出す。
+// 借りた範囲はappごとに重ならないので、複数台でもidは重複しない。
+// redisを使わないので、redisが落ちたりFLUSHされたりしても続きから払い出せる。
+type blockIDAllocator struct {
+	db    *sql.DB
+	table string
+	size  int64
+
+	mu   sync.Mutex
+	next int64
+	end  int64
+}
+
+func newBlockIDAllocator(db *sql.DB, table string, size int64) *blockIDAllocator {
+	return &blockIDAllocator{db: db, table: table, size: size}
+}
+
+func (a *blockIDAllocator) Next(ctx context.Context) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.next >= a.end {
+		start, err := a.lease(ctx)
+		if err != nil {
+			return 0, err
+		}
+		a.next, a.end = start, start+a.size
+	}
+	id := a.next
+	a.next++
+	return id, nil
+}
+
+func (a *blockIDAllocator) Discard() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.next, a.end = 0, 0
+}
+
+func (a *blockIDAllocator) lease(ctx context.Context) (int64, error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var next int64
+	if err := tx.QueryRowContext(ctx, "SELECT next_id FROM id_blocks WHERE name = ? FOR UPDATE", a.table).Scan(&next); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	// データを入れ直したあとでも既存のidと重ならないようにする
+	var max int64
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM "+a.table).Scan(&max); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if next <= max {
+		next = max + 1
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE id_blocks SET next_id = ? WHERE name = ?", next+a.size, a.table); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+func isDuplicateEntry(err error) bool {
+	e, ok := err.(*mysql.MySQLError)
+	return ok && e.Number == 1062
+}
+
+// isRetryable は取り合いで失敗したときのエラーかどうか。重複かデッドロックならやり直せば通ることがある
+func isRetryable(err error) bool {
+	if isDuplicateEntry(err) {
+		return true
+	}
+	e, ok := err.(*mysql.MySQLError)
+	return ok && e.Number == 1213
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	// idempotencyTTL は保存したレスポンスを返し続ける期間
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyPendingTTL は処理中の印を残しておく期間。処理中にappが落ちても、
+	// nginxがタイムアウトを返すくらいの時間が経てば同じキーでやり直せるようにする
+	idempotencyPendingTTL = time.Minute
+)
+
+const idempotencyPending = "pending"
+
+type idempotentResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func idempotencyKey(c echo.Context, key string) string {
+	return fmt.Sprintf("idem_%v_%v_%v_%v", sessUserID(c), c.Request().Method, c.Request().URL.Path, key)
+}
+
+// idempotent はIdempotency-Keyヘッダが付いたリクエストの最初のレスポンスをredisに保存し、
+// 同じキーで再送されたリクエストにはハンドラを呼ばずに保存したレスポンスを返す。
+// loginRequiredの後に使う。redisなしで起動しているときはキーを無視する。
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get("Idempotency-Key")
+		if key == "" || !redisEnabled() {
+			return next(c)
+		}
+		key = idempotencyKey(c, key)
+
+		first, err := client.SetNX(key, idempotencyPending, idempotencyPendingTTL).Result()
+		if err != nil {
+			return err
+		}
+		if !first {
+			v, err := client.Get(key).Result()
+			if err != nil {
+				return err
+			}
+			if v == idempotencyPending {
+				return resError(c, "idempotency_key_in_use", 409)
+			}
+			var res idempotentResponse
+			if err := json.Unmarshal([]byte(v), &res); err != nil {
+				return err
+			}
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.Blob(res.Status, res.ContentType, res.Body)
+		}
+
+		rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = rec
+		if err := next(c); err != nil {
+			client.Del(key)
+			return err
+		}
+		if c.Response().Status >= 500 {
+			client.Del(key)
+			return nil
+		}
+
+		b, err := json.Marshal(idempotentResponse{
+			Status:      c.Response().Status,
+			ContentType: c.Response().Header().Get(echo.HeaderContentType),
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			client.Del(key)
+			log.Println("failed to encode idempotent response:", err)
+			return nil
+		}
+		if err := client.Set(key, b, idempotencyTTL).Err(); err != nil {
+			log.Println("failed to store idempotent response:", err)
+		}
+		return nil
+	}
+}
@@ -19,22 +19,32 @@ func getInitialize(c echo.Context) error {
 	}
 
 	{
-		client.FlushDB()
-		var id int64
+		if redisEnabled() {
+			client.FlushDB()
+		}
+		if err := inventory.Reset(); err != nil {
+			log.Fatalf("failed to initialize: %v", err)
+		}
+		reservationIDs.Discard()
+		if err := resetVenues(c.Request().Context()); err != nil {
+			log.Fatalf("failed to initialize: %v", err)
+		}
 		rows, err := db.Query("SELECT id, event_id, sheet_id, reserved_at FROM reservations WHERE canceled_at IS NULL")
 		if err != nil {
 			log.Fatalf("failed to initialize: %v", err)
 		}
+		// イベントごとにまとめて入れる
+		assigns := make(map[int64][]SeatAssignment)
 		for rows.Next() {
 			r := Reservation{}
 			rows.Scan(&r.ID, &r.EventID, &r.SheetID, &r.ReservedAt)
-			rank, num := Rank(r.SheetID)
-			client.HSet(reserveKey(r.EventID, rank), strconv.Itoa(int(num)), r.ReservedAt.Unix())
-			if id < r.ID {
-				id = r.ID
+			assigns[r.EventID] = append(assigns[r.EventID], SeatAssignment{Sheet: sheetByID(r.SheetID), Value: strconv.FormatInt(r.ReservedAt.Unix(), 10)})
+		}
+		for eventID, assign := range assigns {
+			if err := inventory.Update(eventID, nil, assign); err != nil {
+				log.Fatalf("failed to initialize: %v", err)
 			}
 		}
-		client.Set(reserveIDKey, id, 0)
 	}
 
 	return c.NoContent(204)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// SeatInventory はイベントごとの席の埋まり具合を持つ。
+// 埋まっている席には値が入っていて、予約なら予約時刻のunix time、仮押さえならholdMarkerになる。
+// 予約そのものはreservationsにあり、ここは席を取り合うときの排他と空席探しに使う。
+type SeatInventory interface {
+	// Claim はranks (確保する席のrankを席の数だけ並べたもの) の空席をvenueの席からallocationの方法で選んで、まとめて確保する。
+	// 1席でも足りなければ何も確保せずにerrSoldOutを返す。
+	Claim(eventID int64, venue *Venue, allocation string, ranks []string, value string) ([]Sheet, error)
+	// ClaimSheet は指定された席が空いていれば確保する。
+	ClaimSheet(eventID int64, sheet Sheet, value string) (bool, error)
+	// ClaimSheets は指定された席が全て空いていればまとめて確保する。1席でも埋まっていれば何も確保せずにfalseを返す。
+	ClaimSheets(eventID int64, sheets []Sheet, value string) (bool, error)
+	// Get は席の値を返す。空いていればokはfalse。
+	Get(eventID int64, sheet Sheet) (value string, ok bool, err error)
+	// Set は席の値を上書きする。
+	Set(eventID int64, sheet Sheet, value string) error
+	// Release は席を空ける。
+	Release(eventID int64, sheets []Sheet) error
+	// ReleaseIf は席の値がvalueのままなら空ける。
+	ReleaseIf(eventID int64, sheet Sheet, value string) (bool, error)
+	// Update はreleaseの席を空け、assignの席に値を入れるのを一度に行う。
+	Update(eventID int64, release []Sheet, assign []SeatAssignment) error
+	// Count はrankの埋まっている席の数を返す。
+	Count(eventID int64, rank string) (int64, error)
+	// Snapshot は全イベントの埋まっている席を event id -> sheet id -> 値 で返す。
+	Snapshot() (map[int64]map[int64]string, error)
+	// Reset は全ての席を空ける。
+	Reset() error
+}
+
+type SeatAssignment struct {
+	Sheet Sheet
+	Value string
+}
+
+var inventory SeatInventory
+
+func newSeatInventory(name string) (SeatInventory, error) {
+	switch name {
+	case "", "redis":
+		return &redisInventory{client: client}, nil
+	case "mysql":
+		return &mysqlInventory{db: db}, nil
+	case "memory":
+		return newMemoryInventory(), nil
+	}
+	return nil, fmt.Errorf("unknown seat inventory: %s", name)
+}
+
+// releaseSheets はClaimなどで確保した席を戻す。予約の作成に失敗したときの後始末に使う。
+func releaseSheets(eventID int64, sheets []Sheet) {
+	if err := inventory.Release(eventID, sheets); err != nil {
+		log.Println("failed to release sheet:", err)
+	}
+}
+
+var errUnknownRank = errors.New("unknown rank")
+
+// venueRanks はrankの名前を会場のrankにする。
+func venueRanks(venue *Venue, ranks []string) ([]*VenueRank, error) {
+	vrs := make([]*VenueRank, 0, len(ranks))
+	for _, rank := range ranks {
+		vr := venue.Rank(rank)
+		if vr == nil {
+			return nil, errUnknownRank
+		}
+		vrs = append(vrs, vr)
+	}
+	return vrs, nil
+}
+
+// rankCounts はranksをrankごとの席数にまとめる。orderは最初に出てきた順のrank。
+func rankCounts(ranks []string) ([]string, map[string]int) {
+	var order []string
+	counts := make(map[string]int)
+	for _, rank := range ranks {
+		if counts[rank] == 0 {
+			order = append(order, rank)
+		}
+		counts[rank]++
+	}
+	return order, counts
+}
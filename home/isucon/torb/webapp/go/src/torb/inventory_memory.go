@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// memoryInventory はプロセス内のmapに席を持つ。appが1台のときの開発やテスト用。
+type memoryInventory struct {
+	mu    sync.Mutex
+	seats map[int64]map[int64]memorySeat
+}
+
+type memorySeat struct {
+	sheet Sheet
+	value string
+}
+
+func newMemoryInventory() *memoryInventory {
+	return &memoryInventory{seats: make(map[int64]map[int64]memorySeat)}
+}
+
+func (m *memoryInventory) used(eventID int64, rank string) map[string]string {
+	used := make(map[string]string)
+	for _, seat := range m.seats[eventID] {
+		if seat.sheet.Rank == rank {
+			used[strconv.FormatInt(seat.sheet.Num, 10)] = seat.value
+		}
+	}
+	return used
+}
+
+func (m *memoryInventory) set(eventID int64, sheet Sheet, value string) {
+	if m.seats[eventID] == nil {
+		m.seats[eventID] = make(map[int64]memorySeat)
+	}
+	m.seats[eventID][sheet.ID] = memorySeat{sheet: sheet, value: value}
+}
+
+func (m *memoryInventory) Claim(eventID int64, venue *Venue, allocation string, ranks []string, value string) ([]Sheet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, counts := rankCounts(ranks)
+	vrs, err := venueRanks(venue, order)
+	if err != nil {
+		return nil, err
+	}
+	allocator := allocatorFor(allocation)
+	sheets := make([]Sheet, 0, len(ranks))
+	for _, vr := range vrs {
+		picked := allocator.Allocate(vr, m.used(eventID, vr.Rank), counts[vr.Rank])
+		if len(picked) < counts[vr.Rank] {
+			return nil, errSoldOut
+		}
+		sheets = append(sheets, picked...)
+	}
+	for _, sheet := range sheets {
+		m.set(eventID, sheet, value)
+	}
+	return sheets, nil
+}
+
+func (m *memoryInventory) ClaimSheet(eventID int64, sheet Sheet, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.seats[eventID][sheet.ID]; ok {
+		return false, nil
+	}
+	m.set(eventID, sheet, value)
+	return true, nil
+}
+
+func (m *memoryInventory) ClaimSheets(eventID int64, sheets []Sheet, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sheet := range sheets {
+		if _, ok := m.seats[eventID][sheet.ID]; ok {
+			return false, nil
+		}
+	}
+	for _, sheet := range sheets {
+		m.set(eventID, sheet, value)
+	}
+	return true, nil
+}
+
+func (m *memoryInventory) Get(eventID int64, sheet Sheet) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seat, ok := m.seats[eventID][sheet.ID]
+	return seat.value, ok, nil
+}
+
+func (m *memoryInventory) Set(eventID int64, sheet Sheet, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(eventID, sheet, value)
+	return nil
+}
+
+func (m *memoryInventory) Release(eventID int64, sheets []Sheet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sheet := range sheets {
+		delete(m.seats[eventID], sheet.ID)
+	}
+	return nil
+}
+
+func (m *memoryInventory) ReleaseIf(eventID int64, sheet Sheet, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if seat, ok := m.seats[eventID][sheet.ID]; !ok || seat.value != value {
+		return false, nil
+	}
+	delete(m.seats[eventID], sheet.ID)
+	return true, nil
+}
+
+func (m *memoryInventory) Update(eventID int64, release []Sheet, assign []SeatAssignment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sheet := range release {
+		delete(m.seats[eventID], sheet.ID)
+	}
+	for _, a := range assign {
+		m.set(eventID, a.Sheet, a.Value)
+	}
+	return nil
+}
+
+func (m *memoryInventory) Count(eventID int64, rank string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.used(eventID, rank))), nil
+}
+
+func (m *memoryInventory) Snapshot() (map[int64]map[int64]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seats := make(map[int64]map[int64]string, len(m.seats))
+	for eventID, s := range m.seats {
+		seats[eventID] = make(map[int64]string, len(s))
+		for sheetID, seat := range s {
+			seats[eventID][sheetID] = seat.value
+		}
+	}
+	return seats, nil
+}
+
+func (m *memoryInventory) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seats = make(map[int64]map[int64]memorySeat)
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// mysqlInventory はsheet_claimsテーブルに席を持つ。redisなしで動かすときに使う。
+type mysqlInventory struct {
+	db *sql.DB
+}
+
+func (m *mysqlInventory) Claim(eventID int64, venue *Venue, allocation string, ranks []string, value string) ([]Sheet, error) {
+	order, counts := rankCounts(ranks)
+	vrs, err := venueRanks(venue, order)
+	if err != nil {
+		return nil, err
+	}
+	allocator := allocatorFor(allocation)
+	for attempt := 1; ; attempt++ {
+		sheets, err := m.claim(eventID, allocator, vrs, counts, value)
+		if err != nil && isRetryable(err) && attempt < maxReserveAttempts {
+			log.Println("re-try: rollback by", err)
+			continue
+		}
+		return sheets, err
+	}
+}
+
+func (m *mysqlInventory) claim(eventID int64, allocator SheetAllocator, vrs []*VenueRank, counts map[string]int, value string) ([]Sheet, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var sheets []Sheet
+	for _, vr := range vrs {
+		rows, err := tx.Query("SELECT num, value FROM sheet_claims WHERE event_id = ? AND `rank` = ? FOR UPDATE", eventID, vr.Rank)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		used := make(map[string]string)
+		for rows.Next() {
+			var num int64
+			var v string
+			if err := rows.Scan(&num, &v); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return nil, err
+			}
+			used[strconv.FormatInt(num, 10)] = v
+		}
+		rows.Close()
+
+		picked := allocator.Allocate(vr, used, counts[vr.Rank])
+		if len(picked) < counts[vr.Rank] {
+			tx.Rollback()
+			return nil, errSoldOut
+		}
+		sheets = append(sheets, picked...)
+	}
+
+	for _, sheet := range sheets {
+		if _, err := tx.Exec("INSERT INTO sheet_claims (event_id, sheet_id, `rank`, num, value) VALUES (?, ?, ?, ?, ?)", eventID, sheet.ID, sheet.Rank, sheet.Num, value); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return sheets, nil
+}
+
+func (m *mysqlInventory) ClaimSheet(eventID int64, sheet Sheet, value string) (bool, error) {
+	res, err := m.db.Exec("INSERT IGNORE INTO sheet_claims (event_id, sheet_id, `rank`, num, value) VALUES (?, ?, ?, ?, ?)", eventID, sheet.ID, sheet.Rank, sheet.Num, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (m *mysqlInventory) ClaimSheets(eventID int64, sheets []Sheet, value string) (bool, error) {
+	if len(sheets) == 0 {
+		return true, nil
+	}
+	placeholders := make([]string, 0, len(sheets))
+	args := make([]interface{}, 0, len(sheets)*5)
+	for _, sheet := range sheets {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, eventID, sheet.ID, sheet.Rank, sheet.Num, value)
+	}
+	// 1つのINSERTなので、埋まっている席があれば全て入らない
+	_, err := m.db.Exec("INSERT INTO sheet_claims (event_id, sheet_id, `rank`, num, value) VALUES "+strings.Join(placeholders, ", "), args...)
+	if isDuplicateEntry(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *mysqlInventory) Get(eventID int64, sheet Sheet) (string, bool, error) {
+	var v string
+	err := m.db.QueryRow("SELECT value FROM sheet_claims WHERE event_id = ? AND sheet_id = ?", eventID, sheet.ID).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (m *mysqlInventory) Set(eventID int64, sheet Sheet, value string) error {
+	_, err := m.db.Exec("INSERT INTO sheet_claims (event_id, sheet_id, `rank`, num, value) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", eventID, sheet.ID, sheet.Rank, sheet.Num, value)
+	return err
+}
+
+func (m *mysqlInventory) Release(eventID int64, sheets []Sheet) error {
+	if len(sheets) == 0 {
+		return nil
+	}
+	placeholders := make([]string, 0, len(sheets))
+	args := []interface{}{eventID}
+	for _, sheet := range sheets {
+		placeholders = append(placeholders, "?")
+		args = append(args, sheet.ID)
+	}
+	_, err := m.db.Exec("DELETE FROM sheet_claims WHERE event_id = ? AND sheet_id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	return err
+}
+
+func (m *mysqlInventory) ReleaseIf(eventID int64, sheet Sheet, value string) (bool, error) {
+	res, err := m.db.Exec("DELETE FROM sheet_claims WHERE event_id = ? AND sheet_id = ? AND value = ?", eventID, sheet.ID, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (m *mysqlInventory) Update(eventID int64, release []Sheet, assign []SeatAssignment) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, sheet := range release {
+		if _, err := tx.Exec("DELETE FROM sheet_claims WHERE event_id = ? AND sheet_id = ?", eventID, sheet.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, a := range assign {
+		if _, err := tx.Exec("INSERT INTO sheet_claims (event_id, sheet_id, `rank`, num, value) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", eventID, a.Sheet.ID, a.Sheet.Rank, a.Sheet.Num, a.Value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *mysqlInventory) Count(eventID int64, rank string) (int64, error) {
+	var n int64
+	err := m.db.QueryRow("SELECT COUNT(*) FROM sheet_claims WHERE event_id = ? AND `rank` = ?", eventID, rank).Scan(&n)
+	return n, err
+}
+
+func (m *mysqlInventory) Snapshot() (map[int64]map[int64]string, error) {
+	rows, err := m.db.Query("SELECT event_id, sheet_id, value FROM sheet_claims")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seats := make(map[int64]map[int64]string)
+	for rows.Next() {
+		var eventID, sheetID int64
+		var v string
+		if err := rows.Scan(&eventID, &sheetID, &v); err != nil {
+			return nil, err
+		}
+		if seats[eventID] == nil {
+			seats[eventID] = make(map[int64]string)
+		}
+		seats[eventID][sheetID] = v
+	}
+	return seats, rows.Err()
+}
+
+func (m *mysqlInventory) Reset() error {
+	_, err := m.db.Exec("DELETE FROM sheet_claims")
+	return err
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// claimSheetsScript はrankごとの r_<event>_<rank> のハッシュから空席を選び、そのまま確保する。
+// 全てのrankで席が足りる場合だけ書き込むので、途中で売り切れても確保済みの席を戻す必要はない。
+//
+// KEYS[i] : rankごとのreserveKey
+// ARGV    : allocation, 書き込む値, 乱数のseed, 続けてKEYSと同じ順にrankの席数と確保する数と1行の席数
+// 戻り値  : KEYSと同じ順に確保したnumの配列。足りなければ空の配列
+//
+// 席の選び方はallocate.goのSheetAllocatorと同じ
+var claimSheetsScript = redis.NewScript(`
+local allocation, value = ARGV[1], ARGV[2]
+math.randomseed(tonumber(ARGV[3]))
+
+local frees = {}
+for k = 1, #KEYS do
+	local total, n = tonumber(ARGV[1 + k * 3]), tonumber(ARGV[2 + k * 3])
+	local used = {}
+	for _, num in ipairs(redis.call("HKEYS", KEYS[k])) do
+		used[tonumber(num)] = true
+	end
+	local free = {}
+	for i = 1, total do
+		if not used[i] then
+			free[#free + 1] = i
+		end
+	end
+	if #free < n then
+		return {}
+	end
+	frees[k] = free
+end
+
+local result = {}
+for k = 1, #KEYS do
+	local free, n, columns = frees[k], tonumber(ARGV[2 + k * 3]), tonumber(ARGV[3 + k * 3])
+	local picked = {}
+	if allocation == "lowest" then
+		for i = 1, n do
+			picked[i] = free[i]
+		end
+	elseif allocation == "contiguous" then
+		-- 行の端で区間を切る
+		local runs, first = {}, 1
+		for i = 2, #free + 1 do
+			if i > #free or free[i] ~= free[i - 1] + 1 or (columns > 0 and math.floor((free[i] - 1) / columns) ~= math.floor((free[i - 1] - 1) / columns)) then
+				runs[#runs + 1] = {first, i - 1}
+				first = i
+			end
+		end
+		local best
+		for _, run in ipairs(runs) do
+			local len = run[2] - run[1] + 1
+			if len >= n and (best == nil or len < best[2] - best[1] + 1) then
+				best = run
+			end
+		end
+		if best then
+			for i = 1, n do
+				picked[i] = free[best[1] + i - 1]
+			end
+		else
+			table.sort(runs, function(a, b)
+				if a[2] - a[1] ~= b[2] - b[1] then
+					return a[2] - a[1] > b[2] - b[1]
+				end
+				return a[1] < b[1]
+			end)
+			for _, run in ipairs(runs) do
+				for i = run[1], run[2] do
+					if #picked < n then
+						picked[#picked + 1] = free[i]
+					end
+				end
+			end
+		end
+	else
+		for i = 1, n do
+			local j = math.random(i, #free)
+			free[i], free[j] = free[j], free[i]
+			picked[i] = free[i]
+		end
+	end
+	for _, num in ipairs(picked) do
+		redis.call("HSET", KEYS[k], num, value)
+	end
+	result[k] = picked
+end
+return result
+`)
+
+func reserveKey(eventID int64, rank string) string {
+	return fmt.Sprintf("r_%v_%v", eventID, rank)
+}
+
+// redisInventory は r_<event>_<rank> のハッシュに num -> 値 で席を持つ。
+type redisInventory struct {
+	client *redis.Client
+}
+
+func (r *redisInventory) Claim(eventID int64, venue *Venue, allocation string, ranks []string, value string) ([]Sheet, error) {
+	order, counts := rankCounts(ranks)
+	vrs, err := venueRanks(venue, order)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(order))
+	args := []interface{}{allocation, value, rand.Int31()}
+	for _, vr := range vrs {
+		keys = append(keys, reserveKey(eventID, vr.Rank))
+		args = append(args, vr.Num, counts[vr.Rank], vr.Columns)
+	}
+
+	res, err := claimSheetsScript.Run(r.client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	picked, _ := res.([]interface{})
+	if len(picked) < len(order) {
+		return nil, errSoldOut
+	}
+
+	sheets := make([]Sheet, 0, len(ranks))
+	for i, vr := range vrs {
+		nums, _ := picked[i].([]interface{})
+		for _, num := range nums {
+			sheet, _ := vr.Sheet(num.(int64))
+			sheets = append(sheets, sheet)
+		}
+	}
+	return sheets, nil
+}
+
+func (r *redisInventory) ClaimSheet(eventID int64, sheet Sheet, value string) (bool, error) {
+	return r.client.HSetNX(reserveKey(eventID, sheet.Rank), strconv.Itoa(int(sheet.Num)), value).Result()
+}
+
+// claimFieldsScript はKEYS[i]のハッシュのARGVのnumが全て空いていれば、まとめて値を入れる。
+//
+// ARGV : 書き込む値, 続けてKEYSと同じ順にkeyごとのnumの数とnum
+// 戻り値 : 確保できれば1、1席でも埋まっていれば0
+var claimFieldsScript = redis.NewScript(`
+local value = ARGV[1]
+local fields, i = {}, 2
+for k = 1, #KEYS do
+	local n = tonumber(ARGV[i])
+	fields[k] = {}
+	for j = 1, n do
+		local num = ARGV[i + j]
+		if redis.call("HEXISTS", KEYS[k], num) == 1 then
+			return 0
+		end
+		fields[k][j] = num
+	end
+	i = i + n + 1
+end
+for k = 1, #KEYS do
+	for _, num in ipairs(fields[k]) do
+		redis.call("HSET", KEYS[k], num, value)
+	end
+end
+return 1
+`)
+
+// sheetsByKey は席をreserveKeyごとのnumにまとめる。
+func sheetsByKey(eventID int64, sheets []Sheet) ([]string, map[string][]string) {
+	var keys []string
+	nums := make(map[string][]string)
+	for _, sheet := range sheets {
+		key := reserveKey(eventID, sheet.Rank)
+		if _, ok := nums[key]; !ok {
+			keys = append(keys, key)
+		}
+		nums[key] = append(nums[key], strconv.FormatInt(sheet.Num, 10))
+	}
+	return keys, nums
+}
+
+func (r *redisInventory) ClaimSheets(eventID int64, sheets []Sheet, value string) (bool, error) {
+	if len(sheets) == 0 {
+		return true, nil
+	}
+	keys, nums := sheetsByKey(eventID, sheets)
+	args := []interface{}{value}
+	for _, key := range keys {
+		args = append(args, len(nums[key]))
+		for _, num := range nums[key] {
+			args = append(args, num)
+		}
+	}
+	n, err := claimFieldsScript.Run(r.client, keys, args...).Int64()
+	return n > 0, err
+}
+
+func (r *redisInventory) Get(eventID int64, sheet Sheet) (string, bool, error) {
+	v, err := r.client.HGet(reserveKey(eventID, sheet.Rank), strconv.Itoa(int(sheet.Num))).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (r *redisInventory) Set(eventID int64, sheet Sheet, value string) error {
+	return r.client.HSet(reserveKey(eventID, sheet.Rank), strconv.Itoa(int(sheet.Num)), value).Err()
+}
+
+func (r *redisInventory) Release(eventID int64, sheets []Sheet) error {
+	keys, nums := sheetsByKey(eventID, sheets)
+	for _, key := range keys {
+		if err := r.client.HDel(key, nums[key]...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HGETした値から変わっていなければ消す
+var compareAndHDel = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func (r *redisInventory) ReleaseIf(eventID int64, sheet Sheet, value string) (bool, error) {
+	n, err := compareAndHDel.Run(r.client, []string{reserveKey(eventID, sheet.Rank)}, strconv.Itoa(int(sheet.Num)), value).Int64()
+	return n > 0, err
+}
+
+func (r *redisInventory) Update(eventID int64, release []Sheet, assign []SeatAssignment) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, sheet := range release {
+			pipe.HDel(reserveKey(eventID, sheet.Rank), strconv.Itoa(int(sheet.Num)))
+		}
+		for _, a := range assign {
+			pipe.HSet(reserveKey(eventID, a.Sheet.Rank), strconv.Itoa(int(a.Sheet.Num)), a.Value)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisInventory) Count(eventID int64, rank string) (int64, error) {
+	return r.client.HLen(reserveKey(eventID, rank)).Result()
+}
+
+func (r *redisInventory) scanKeys(fn func(key string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, "r_*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, _, ok := parseReserveKey(key); !ok {
+				continue
+			}
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *redisInventory) Snapshot() (map[int64]map[int64]string, error) {
+	seats := make(map[int64]map[int64]string)
+	err := r.scanKeys(func(key string) error {
+		eventID, rank, _ := parseReserveKey(key)
+		venue, err := venueOfEvent(context.Background(), eventID)
+		if err != nil {
+			return err
+		}
+		vr := venue.Rank(rank)
+		if vr == nil {
+			return nil
+		}
+		s, err := r.client.HGetAll(key).Result()
+		if err != nil {
+			return err
+		}
+		if seats[eventID] == nil {
+			seats[eventID] = make(map[int64]string)
+		}
+		for field, v := range s {
+			num, _ := strconv.ParseInt(field, 10, 64)
+			if sheet, ok := vr.Sheet(num); ok {
+				seats[eventID][sheet.ID] = v
+			}
+		}
+		return nil
+	})
+	return seats, err
+}
+
+func (r *redisInventory) Reset() error {
+	return r.scanKeys(func(key string) error {
+		return r.client.Del(key).Err()
+	})
+}
+
+func parseReserveKey(key string) (int64, string, bool) {
+	v := strings.Split(key, "_")
+	if len(v) != 3 || v[0] != "r" {
+		return 0, "", false
+	}
+	eventID, err := strconv.ParseInt(v[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return eventID, v[2], true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+const testEventID = 999999
+
+// testVenue はSが10席、Aが20席の会場を作る。
+func testVenue() *Venue {
+	venue := &Venue{ID: 1}
+	id := int64(1)
+	for _, r := range []struct {
+		rank string
+		num  int64
+	}{{"S", 10}, {"A", 20}} {
+		vr := &VenueRank{Rank: r.rank, Num: r.num, Rows: 1, Columns: r.num}
+		for num := int64(1); num <= r.num; num++ {
+			vr.Sheets = append(vr.Sheets, Sheet{ID: id, Rank: r.rank, Num: num})
+			id++
+		}
+		venue.Ranks = append(venue.Ranks, vr)
+		venue.Capacity += r.num
+	}
+	return venue
+}
+
+// testClaimConcurrently はworkers個のgoroutineからranksの席を売り切れるまで取り合い、
+// 同じ席が2度確保されないこと、席がなくなったらerrSoldOutになることを確かめる。
+func testClaimConcurrently(t *testing.T, inv SeatInventory, allocation string, ranks []string, workers int) {
+	venue := testVenue()
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	succeeded := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 同じ席を何度も確保してしまう場合にも終わるように、会場の席数で打ち切る
+			for i := int64(0); i <= venue.Capacity; i++ {
+				sheets, err := inv.Claim(testEventID, venue, allocation, ranks, "1")
+				if err == errSoldOut {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(sheets) != len(ranks) {
+					t.Errorf("claimed %d sheets, want %d", len(sheets), len(ranks))
+				}
+				mu.Lock()
+				succeeded++
+				for _, sheet := range sheets {
+					claimed[fmt.Sprintf("%d_%s_%d", testEventID, sheet.Rank, sheet.Num)]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for key, n := range claimed {
+		if n > 1 {
+			t.Errorf("%s claimed %d times", key, n)
+		}
+	}
+
+	// rankごとの席数から、売り切れるまでに成功するはずのClaimの回数を出す
+	_, counts := rankCounts(ranks)
+	want := -1
+	for rank, n := range counts {
+		if c := int(venue.Rank(rank).Num) / n; want < 0 || c < want {
+			want = c
+		}
+	}
+	if succeeded != want {
+		t.Errorf("succeeded %d claims, want %d", succeeded, want)
+	}
+	for rank, n := range counts {
+		count, err := inv.Count(testEventID, rank)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(want*n) {
+			t.Errorf("rank %s has %d sheets claimed, want %d", rank, count, want*n)
+		}
+	}
+	if _, err := inv.Claim(testEventID, venue, allocation, ranks, "1"); err != errSoldOut {
+		t.Errorf("claim after sold out returned %v, want errSoldOut", err)
+	}
+}
+
+func testSeatInventory(t *testing.T, newInventory func(t *testing.T) SeatInventory) {
+	for _, allocation := range []string{"random", "lowest", "contiguous"} {
+		for _, ranks := range [][]string{{"S"}, {"A", "A", "A"}, {"S", "A"}} {
+			t.Run(fmt.Sprintf("%s/%v", allocation, ranks), func(t *testing.T) {
+				testClaimConcurrently(t, newInventory(t), allocation, ranks, 16)
+			})
+		}
+	}
+}
+
+func TestMemoryInventoryClaim(t *testing.T) {
+	testSeatInventory(t, func(t *testing.T) SeatInventory {
+		return newMemoryInventory()
+	})
+}
+
+// TestRedisInventoryClaim はclaimSheetsScriptを実際のredisで確かめる。
+// TEST_REDIS_ADDR にredisのアドレスを入れたときだけ走る。
+func TestRedisInventoryClaim(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	rc := redis.NewClient(&redis.Options{Addr: addr})
+	defer rc.Close()
+	if err := rc.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{reserveKey(testEventID, "S"), reserveKey(testEventID, "A")}
+	defer rc.Del(keys...)
+	testSeatInventory(t, func(t *testing.T) SeatInventory {
+		if err := rc.Del(keys...).Err(); err != nil {
+			t.Fatal(err)
+		}
+		return &redisInventory{client: rc}
+	})
+}
+
+func TestMemoryInventoryClaimSheets(t *testing.T) {
+	inv := newMemoryInventory()
+	venue := testVenue()
+	sheets := venue.Rank("A").Sheets[15:]
+	if ok, _ := inv.ClaimSheet(testEventID, sheets[2], "1"); !ok {
+		t.Fatal("failed to claim a free sheet")
+	}
+	if ok, _ := inv.ClaimSheets(testEventID, sheets, "2"); ok {
+		t.Error("claimed sheets including a taken one")
+	}
+	if count, _ := inv.Count(testEventID, "A"); count != 1 {
+		t.Errorf("rank A has %d sheets claimed, want 1", count)
+	}
+	inv.Release(testEventID, sheets[2:3])
+	if ok, _ := inv.ClaimSheets(testEventID, sheets, "2"); !ok {
+		t.Error("failed to claim free sheets")
+	}
+	if count, _ := inv.Count(testEventID, "A"); count != int64(len(sheets)) {
+		t.Errorf("rank A has %d sheets claimed, want %d", count, len(sheets))
+	}
+}
+
+// 連続した席は行をまたがない。2行5列で1から3番が埋まっていれば、4, 5番ではなく次の行から3席取る
+func TestContiguousAllocatorRows(t *testing.T) {
+	rank := &VenueRank{Rank: "S", Num: 10, Rows: 2, Columns: 5}
+	for num := int64(1); num <= rank.Num; num++ {
+		rank.Sheets = append(rank.Sheets, Sheet{ID: num, Rank: "S", Num: num})
+	}
+	used := map[string]string{"1": "1", "2": "1", "3": "1"}
+	sheets := contiguousAllocator{}.Allocate(rank, used, 3)
+	var nums []int64
+	for _, sheet := range sheets {
+		nums = append(nums, sheet.Num)
+	}
+	if fmt.Sprint(nums) != "[6 7 8]" {
+		t.Errorf("allocated %v, want [6 7 8]", nums)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// SeatChange はイベントの席の変化。remains は変化のあったrankの残席数。
+type SeatChange struct {
+	EventID int64            `json:"event_id"`
+	Sheets  []*SheetChange   `json:"sheets"`
+	Remains map[string]int64 `json:"remains"`
+}
+
+type SheetChange struct {
+	Rank     string `json:"rank"`
+	Num      int64  `json:"num"`
+	Reserved bool   `json:"reserved"`
+	Held     bool   `json:"held,omitempty"`
+}
+
+var streamHeartbeat = 15 * time.Second
+
+const seatsChannelPrefix = "seats_"
+
+func seatsChannel(eventID int64) string {
+	return seatsChannelPrefix + strconv.FormatInt(eventID, 10)
+}
+
+// notifyingInventory は席が変わるたびに変化をredisにpublishする。
+// appが複数台でも、どのappで予約やキャンセルがあってもstreamに流れる。
+type notifyingInventory struct {
+	SeatInventory
+}
+
+// silentInventory はinventoryから、席の変化をpublishしない元のinventoryを取り出す。
+func silentInventory(inv SeatInventory) SeatInventory {
+	if n, ok := inv.(*notifyingInventory); ok {
+		return n.SeatInventory
+	}
+	return inv
+}
+
+func (n *notifyingInventory) Claim(eventID int64, venue *Venue, allocation string, ranks []string, value string) ([]Sheet, error) {
+	sheets, err := n.SeatInventory.Claim(eventID, venue, allocation, ranks, value)
+	if err == nil {
+		n.publish(eventID, sheets, value)
+	}
+	return sheets, err
+}
+
+func (n *notifyingInventory) ClaimSheet(eventID int64, sheet Sheet, value string) (bool, error) {
+	ok, err := n.SeatInventory.ClaimSheet(eventID, sheet, value)
+	if ok {
+		n.publish(eventID, []Sheet{sheet}, value)
+	}
+	return ok, err
+}
+
+func (n *notifyingInventory) Set(eventID int64, sheet Sheet, value string) error {
+	err := n.SeatInventory.Set(eventID, sheet, value)
+	if err == nil {
+		n.publish(eventID, []Sheet{sheet}, value)
+	}
+	return err
+}
+
+func (n *notifyingInventory) Release(eventID int64, sheets []Sheet) error {
+	err := n.SeatInventory.Release(eventID, sheets)
+	if err == nil {
+		n.publish(eventID, sheets, "")
+	}
+	return err
+}
+
+func (n *notifyingInventory) ReleaseIf(eventID int64, sheet Sheet, value string) (bool, error) {
+	ok, err := n.SeatInventory.ReleaseIf(eventID, sheet, value)
+	if ok {
+		n.publish(eventID, []Sheet{sheet}, "")
+	}
+	return ok, err
+}
+
+func (n *notifyingInventory) Update(eventID int64, release []Sheet, assign []SeatAssignment) error {
+	if err := n.SeatInventory.Update(eventID, release, assign); err != nil {
+		return err
+	}
+	changes := make([]*SheetChange, 0, len(release)+len(assign))
+	for _, sheet := range release {
+		changes = append(changes, sheetChange(sheet, ""))
+	}
+	for _, a := range assign {
+		changes = append(changes, sheetChange(a.Sheet, a.Value))
+	}
+	n.send(eventID, changes)
+	return nil
+}
+
+func sheetChange(sheet Sheet, value string) *SheetChange {
+	return &SheetChange{Rank: sheet.Rank, Num: sheet.Num, Reserved: value != "", Held: isHoldMarker(value)}
+}
+
+func (n *notifyingInventory) publish(eventID int64, sheets []Sheet, value string) {
+	changes := make([]*SheetChange, 0, len(sheets))
+	for _, sheet := range sheets {
+		changes = append(changes, sheetChange(sheet, value))
+	}
+	n.send(eventID, changes)
+}
+
+func (n *notifyingInventory) send(eventID int64, changes []*SheetChange) {
+	if len(changes) == 0 || !redisEnabled() {
+		return
+	}
+	var ranks []string
+	for _, change := range changes {
+		ranks = append(ranks, change.Rank)
+	}
+	order, _ := rankCounts(ranks)
+	venue, err := venueOfEvent(context.Background(), eventID)
+	if err != nil {
+		log.Println("failed to get venue:", err)
+		return
+	}
+	remains, err := seatRemains(n.SeatInventory, eventID, venue, order)
+	if err != nil {
+		log.Println("failed to count remains:", err)
+		return
+	}
+	b, err := json.Marshal(SeatChange{EventID: eventID, Sheets: changes, Remains: remains})
+	if err != nil {
+		log.Println("failed to marshal seat change:", err)
+		return
+	}
+	if err := client.Publish(seatsChannel(eventID), b).Err(); err != nil {
+		log.Println("failed to publish seat change:", err)
+	}
+}
+
+func seatRemains(inv SeatInventory, eventID int64, venue *Venue, ranks []string) (map[string]int64, error) {
+	remains := make(map[string]int64, len(ranks))
+	for _, rank := range ranks {
+		vr := venue.Rank(rank)
+		if vr == nil {
+			continue
+		}
+		n, err := inv.Count(eventID, rank)
+		if err != nil {
+			return nil, err
+		}
+		remains[rank] = vr.Num - n
+	}
+	return remains, nil
+}
+
+// getAPIEventStream はイベントの残席と席の変化をServer-Sent Eventsで流し続ける。
+// 最初に全rankの残席を送り、そのあとは席が変わるたびに送る。
+func getAPIEventStream(c echo.Context) error {
+	ctx := c.Request().Context()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	event, err := getEventBase(ctx, eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	} else if !event.PublicFg {
+		return resError(c, "not_found", 404)
+	}
+
+	// subscribeしてから残席を数えて、その間の変化を取りこぼさないようにする
+	ch := streams.subscribe(seatsChannel(event.ID))
+	defer streams.unsubscribe(seatsChannel(event.ID), ch)
+	remains, err := seatRemains(inventory, event.ID, event.Venue, event.Venue.RankNames())
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(SeatChange{EventID: event.ID, Sheets: []*SheetChange{}, Remains: remains})
+	if err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginxでバッファされないようにする
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(200)
+	fmt.Fprintf(res, "event: seats\ndata: %s\n\n", b)
+	res.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case payload, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(res, "event: seats\ndata: %s\n\n", payload)
+			res.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(res, ": ping\n\n")
+			res.Flush()
+		}
+	}
+}
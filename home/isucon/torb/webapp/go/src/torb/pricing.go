@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// PricingRule はイベントの席の価格を売れ行きや時期で上げ下げするルール。
+// Rank (空なら全rank)、SoldRatio (rankの席のうち仮押さえを含めて埋まっている割合(%)がこれ以上、0なら条件なし)、
+// Before (この時刻より前) の条件を全て満たすときに、価格をPercent%とAmountだけ変える。
+// 当てはまるルールが複数あれば全て足し合わせる。
+type PricingRule struct {
+	ID        int64      `json:"id"`
+	EventID   int64      `json:"event_id"`
+	Rank      string     `json:"rank"`
+	SoldRatio int64      `json:"sold_ratio"`
+	Before    *time.Time `json:"-"`
+	Percent   int64      `json:"percent"`
+	Amount    int64      `json:"amount"`
+
+	BeforeUnix int64 `json:"before"`
+}
+
+const pricingRuleColumns = "id, event_id, `rank`, sold_ratio, before_at, percent, amount"
+
+func scanPricingRules(rows *sql.Rows) ([]*PricingRule, error) {
+	defer rows.Close()
+	rules := make([]*PricingRule, 0)
+	for rows.Next() {
+		var rule PricingRule
+		if err := rows.Scan(&rule.ID, &rule.EventID, &rule.Rank, &rule.SoldRatio, &rule.Before, &rule.Percent, &rule.Amount); err != nil {
+			return nil, err
+		}
+		rule.BeforeUnix = unixOrZero(rule.Before)
+		rules = append(rules, &rule)
+	}
+	return rules, rows.Err()
+}
+
+func getPricingRules(ctx context.Context, eventID int64) ([]*PricingRule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+pricingRuleColumns+" FROM pricing_rules WHERE event_id = ? ORDER BY id ASC", eventID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPricingRules(rows)
+}
+
+// getAllPricingRules はイベント一覧のために全イベントのルールを event id -> ルール で返す。
+func getAllPricingRules(ctx context.Context) (map[int64][]*PricingRule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+pricingRuleColumns+" FROM pricing_rules ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	rules, err := scanPricingRules(rows)
+	if err != nil {
+		return nil, err
+	}
+	byEvent := make(map[int64][]*PricingRule)
+	for _, rule := range rules {
+		byEvent[rule.EventID] = append(byEvent[rule.EventID], rule)
+	}
+	return byEvent, nil
+}
+
+func (rule *PricingRule) matches(rank *VenueRank, sold int, now time.Time) bool {
+	if rule.Rank != "" && rule.Rank != rank.Rank {
+		return false
+	}
+	if rule.SoldRatio > 0 && int64(sold)*100 < rule.SoldRatio*rank.Num {
+		return false
+	}
+	if rule.Before != nil && !now.Before(*rule.Before) {
+		return false
+	}
+	return true
+}
+
+// rankPrice はsold席が埋まっているrankの、nowの時点での1席の価格を返す。
+func (e *Event) rankPrice(rank *VenueRank, sold int, now time.Time) int64 {
+	base := e.Price + rank.Price
+	price := base
+	for _, rule := range e.PricingRules {
+		if rule.matches(rank, sold, now) {
+			price += base*rule.Percent/100 + rule.Amount
+		}
+	}
+	if price < 0 {
+		return 0
+	}
+	return price
+}
+
+// chargePrice は予約で請求する席の価格。Sheetsを埋めたeventなら表示している価格をそのまま使う。
+func (e *Event) chargePrice(sheet Sheet) int64 {
+	if s, ok := e.Sheets[sheet.Rank]; ok {
+		return s.Price
+	}
+	return e.Price + sheet.Price
+}
+
+func getAdminPricingRules(c echo.Context) error {
+	ctx := c.Request().Context()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	event, err := getEventBase(ctx, eventID)
+	if err == sql.ErrNoRows {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(200, event.PricingRules)
+}
+
+func postAdminPricingRule(c echo.Context) error {
+	ctx := c.Request().Context()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank      string `json:"rank"`
+		SoldRatio int64  `json:"sold_ratio"`
+		Before    int64  `json:"before"`
+		Percent   int64  `json:"percent"`
+		Amount    int64  `json:"amount"`
+	}
+	c.Bind(&params)
+
+	event, err := getEventBase(ctx, eventID)
+	if err == sql.ErrNoRows {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+	if params.Rank != "" && !validateRank(event.Venue, params.Rank) {
+		return resError(c, "invalid_rank", 400)
+	}
+	if params.SoldRatio < 0 || params.SoldRatio > 100 || params.Before < 0 || params.Percent < -100 || (params.Percent == 0 && params.Amount == 0) {
+		return resError(c, "invalid_pricing_rule", 400)
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO pricing_rules (event_id, `rank`, sold_ratio, before_at, percent, amount) VALUES (?, ?, ?, ?, ?, ?)", event.ID, params.Rank, params.SoldRatio, timeOrNil(params.Before), params.Percent, params.Amount)
+	if err != nil {
+		return err
+	}
+	ruleID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, PricingRule{
+		ID:         ruleID,
+		EventID:    event.ID,
+		Rank:       params.Rank,
+		SoldRatio:  params.SoldRatio,
+		Percent:    params.Percent,
+		Amount:     params.Amount,
+		BeforeUnix: params.Before,
+	})
+}
+
+func deleteAdminPricingRule(c echo.Context) error {
+	ctx := c.Request().Context()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	ruleID, err := strconv.ParseInt(c.Param("rule_id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM pricing_rules WHERE id = ? AND event_id = ?", ruleID, eventID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "not_found", 404)
+	}
+	return c.NoContent(204)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// PromoCode は予約のときに入力する割引コード。
+// Kind が percent なら席の価格のValue%、amount ならValue円を1席ごとに割り引く。
+// EventIDs と Ranks が空ならどのイベント、rankにも使える。
+// MaxUses は予約 (1回のpostReserve) で使える回数で、0なら無制限。
+type PromoCode struct {
+	ID       int64      `json:"id"`
+	Code     string     `json:"code"`
+	Kind     string     `json:"kind"`
+	Value    int64      `json:"value"`
+	MaxUses  int64      `json:"max_uses"`
+	Used     int64      `json:"used"`
+	StartsAt *time.Time `json:"-"`
+	EndsAt   *time.Time `json:"-"`
+	EventIDs []int64    `json:"event_ids"`
+	Ranks    []string   `json:"ranks"`
+
+	StartsAtUnix int64 `json:"starts_at"`
+	EndsAtUnix   int64 `json:"ends_at"`
+}
+
+var errPromoCodeExhausted = errors.New("promo code exhausted")
+
+var promoCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const promoCodeColumns = "id, code, kind, value, max_uses, used, starts_at, ends_at, event_ids, ranks"
+
+func scanPromoCode(row rowScanner, promo *PromoCode) error {
+	var eventIDs, ranks string
+	if err := row.Scan(&promo.ID, &promo.Code, &promo.Kind, &promo.Value, &promo.MaxUses, &promo.Used, &promo.StartsAt, &promo.EndsAt, &eventIDs, &ranks); err != nil {
+		return err
+	}
+	promo.EventIDs = make([]int64, 0)
+	for _, v := range splitList(eventIDs) {
+		id, _ := strconv.ParseInt(v, 10, 64)
+		promo.EventIDs = append(promo.EventIDs, id)
+	}
+	promo.Ranks = splitList(ranks)
+	promo.StartsAtUnix = unixOrZero(promo.StartsAt)
+	promo.EndsAtUnix = unixOrZero(promo.EndsAt)
+	return nil
+}
+
+// splitList はカンマ区切りの文字列を分ける。空文字列なら空のsliceになる。
+func splitList(s string) []string {
+	if s == "" {
+		return make([]string, 0)
+	}
+	return strings.Split(s, ",")
+}
+
+func getPromoCode(ctx context.Context, code string) (*PromoCode, error) {
+	var promo PromoCode
+	if err := scanPromoCode(db.QueryRowContext(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = ?", code), &promo); err != nil {
+		return nil, err
+	}
+	return &promo, nil
+}
+
+func (p *PromoCode) appliesToRank(rank string) bool {
+	if len(p.Ranks) == 0 {
+		return true
+	}
+	for _, r := range p.Ranks {
+		if r == rank {
+			return true
+		}
+	}
+	return false
+}
+
+// applicable はnowの時点でeventのranksの席の予約に使えるかどうか。割り引く席が1席もなければ使えない。
+func (p *PromoCode) applicable(event *Event, ranks []string, now time.Time) bool {
+	if p.StartsAt != nil && now.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && !now.Before(*p.EndsAt) {
+		return false
+	}
+	if len(p.EventIDs) > 0 {
+		ok := false
+		for _, id := range p.EventIDs {
+			if id == event.ID {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, rank := range ranks {
+		if p.appliesToRank(rank) {
+			return true
+		}
+	}
+	return false
+}
+
+// discount はrankの席をpriceで売るときの割引額。価格より多くは割り引かない。
+func (p *PromoCode) discount(rank string, price int64) int64 {
+	if !p.appliesToRank(rank) {
+		return 0
+	}
+	var d int64
+	switch p.Kind {
+	case "percent":
+		d = price * p.Value / 100
+	case "amount":
+		d = p.Value
+	}
+	if d > price {
+		return price
+	}
+	return d
+}
+
+// usePromoCode は予約のtxでコードの使用回数を1つ増やす。上限に達していればerrPromoCodeExhaustedを返す。
+func usePromoCode(ctx context.Context, tx *sql.Tx, promo *PromoCode) error {
+	res, err := tx.ExecContext(ctx, "UPDATE promo_codes SET used = used + 1 WHERE id = ? AND (max_uses = 0 OR used < max_uses)", promo.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errPromoCodeExhausted
+	}
+	return nil
+}
+
+func getAdminPromoCodes(c echo.Context) error {
+	ctx := c.Request().Context()
+	rows, err := db.QueryContext(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	promos := make([]*PromoCode, 0)
+	for rows.Next() {
+		var promo PromoCode
+		if err := scanPromoCode(rows, &promo); err != nil {
+			return err
+		}
+		promos = append(promos, &promo)
+	}
+	return c.JSON(200, promos)
+}
+
+func postAdminPromoCode(c echo.Context) error {
+	ctx := c.Request().Context()
+	var params struct {
+		Code     string   `json:"code"`
+		Kind     string   `json:"kind"`
+		Value    int64    `json:"value"`
+		MaxUses  int64    `json:"max_uses"`
+		StartsAt int64    `json:"starts_at"`
+		EndsAt   int64    `json:"ends_at"`
+		EventIDs []int64  `json:"event_ids"`
+		Ranks    []string `json:"ranks"`
+	}
+	c.Bind(&params)
+
+	if !promoCodePattern.MatchString(params.Code) {
+		return resError(c, "invalid_code", 400)
+	}
+	switch {
+	case params.Kind == "percent" && params.Value > 0 && params.Value <= 100:
+	case params.Kind == "amount" && params.Value > 0:
+	default:
+		return resError(c, "invalid_discount", 400)
+	}
+	if params.MaxUses < 0 || !validateSchedule(params.StartsAt, params.EndsAt) {
+		return resError(c, "invalid_promo_code", 400)
+	}
+	eventIDs := make([]string, 0, len(params.EventIDs))
+	for _, id := range params.EventIDs {
+		if _, err := getEventBase(ctx, id); err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 400)
+		} else if err != nil {
+			return err
+		}
+		eventIDs = append(eventIDs, strconv.FormatInt(id, 10))
+	}
+	for _, rank := range params.Ranks {
+		if !rankNamePattern.MatchString(rank) {
+			return resError(c, "invalid_rank", 400)
+		}
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO promo_codes (code, kind, value, max_uses, used, starts_at, ends_at, event_ids, ranks) VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?)", params.Code, params.Kind, params.Value, params.MaxUses, timeOrNil(params.StartsAt), timeOrNil(params.EndsAt), strings.Join(eventIDs, ","), strings.Join(params.Ranks, ","))
+	if isDuplicateEntry(err) {
+		return resError(c, "duplicate_code", 409)
+	} else if err != nil {
+		return err
+	}
+	promoID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	var promo PromoCode
+	if err := scanPromoCode(db.QueryRowContext(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE id = ?", promoID), &promo); err != nil {
+		return err
+	}
+	return c.JSON(201, promo)
+}
+
+func deleteAdminPromoCode(c echo.Context) error {
+	ctx := c.Request().Context()
+	promoID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM promo_codes WHERE id = ?", promoID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "not_found", 404)
+	}
+	return c.NoContent(204)
+}
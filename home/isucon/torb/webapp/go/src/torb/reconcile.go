@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+)
+
+// ReconcileEntry はinventoryとDBで食い違っていた席
+type ReconcileEntry struct {
+	EventID   int64  `json:"event_id"`
+	SheetRank string `json:"sheet_rank"`
+	SheetNum  int64  `json:"sheet_num"`
+}
+
+// ReconcileReport はreconcileの結果。
+// Missing はDBで予約されているのにinventoryで空いている席、Stale はinventoryで埋まっているのにDBに予約がない席。
+type ReconcileReport struct {
+	CheckedAt int64             `json:"checked_at"`
+	Missing   []*ReconcileEntry `json:"missing"`
+	Stale     []*ReconcileEntry `json:"stale"`
+	Repaired  bool              `json:"repaired"`
+}
+
+var (
+	reconcileReportKey = "reconcile_report"
+	reconcileLockKey   = "reconcile_lock"
+
+	reconcileInterval = 5 * time.Minute
+	// DBのcommit前にinventoryへ書いている予約を消さないように、これより新しい席はstaleとしない
+	reconcileGrace = time.Minute
+)
+
+// reconcile はinventoryの席と reservations の有効な予約を突き合わせる。
+// repair ならinventoryをDBに合わせて直す。
+func reconcile(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	now := time.Now()
+	report := &ReconcileReport{
+		CheckedAt: now.Unix(),
+		Missing:   make([]*ReconcileEntry, 0),
+		Stale:     make([]*ReconcileEntry, 0),
+		Repaired:  repair,
+	}
+
+	// commit前の予約はinventoryにだけあるので、inventoryを先に読んでからDBを読む
+	seats, err := inventory.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	holds, err := getHolds()
+	if err != nil {
+		return nil, err
+	}
+	holding := make(map[string]bool)
+	for _, hold := range holds {
+		holding[holdMarker(hold.ID)] = true
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT event_id, sheet_id, reserved_at FROM reservations WHERE canceled_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reserved := make(map[int64]map[int64]bool)
+	for rows.Next() {
+		var eventID, sheetID int64
+		var reservedAt time.Time
+		if err := rows.Scan(&eventID, &sheetID, &reservedAt); err != nil {
+			return nil, err
+		}
+		if reserved[eventID] == nil {
+			reserved[eventID] = make(map[int64]bool)
+		}
+		reserved[eventID][sheetID] = true
+
+		v, ok := seats[eventID][sheetID]
+		if ok && !isHoldMarker(v) {
+			continue
+		}
+		sheet := sheetByID(sheetID)
+		report.Missing = append(report.Missing, &ReconcileEntry{EventID: eventID, SheetRank: sheet.Rank, SheetNum: sheet.Num})
+		if repair {
+			if err := inventory.Set(eventID, sheet, strconv.FormatInt(reservedAt.Unix(), 10)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for eventID, s := range seats {
+		for sheetID, v := range s {
+			if reserved[eventID][sheetID] {
+				continue
+			}
+			if isHoldMarker(v) {
+				if holding[v] {
+					continue
+				}
+			} else if unix, err := strconv.ParseInt(v, 10, 64); err == nil && now.Sub(time.Unix(unix, 0)) < reconcileGrace {
+				continue
+			}
+			sheet := sheetByID(sheetID)
+			report.Stale = append(report.Stale, &ReconcileEntry{EventID: eventID, SheetRank: sheet.Rank, SheetNum: sheet.Num})
+			if repair {
+				if _, err := inventory.ReleaseIf(eventID, sheet, v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if len(report.Missing) > 0 || len(report.Stale) > 0 {
+		log.Printf("reconcile: %d missing, %d stale sheets in inventory (repair: %v)", len(report.Missing), len(report.Stale), repair)
+	}
+	if b, err := json.Marshal(report); err == nil && redisEnabled() {
+		client.Set(reconcileReportKey, b, 0)
+	}
+	return report, nil
+}
+
+func reconcileLoop() {
+	for range time.Tick(reconcileInterval) {
+		// 複数台のappで同時に走らないようにする
+		if !tryLock(reconcileLockKey, reconcileInterval/2) {
+			continue
+		}
+		if _, err := reconcile(context.Background(), true); err != nil {
+			log.Println("failed to reconcile:", err)
+		}
+	}
+}
+
+func postAdminReconcile(c echo.Context) error {
+	ctx := c.Request().Context()
+	report, err := reconcile(ctx, c.QueryParam("dry_run") == "")
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, report)
+}
+
+func getAdminReconcile(c echo.Context) error {
+	v, err := client.Get(reconcileReportKey).Result()
+	if err == redis.Nil {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+	return c.JSONBlob(200, []byte(v))
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
-	"math/rand"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.opencensus.io/trace"
@@ -26,15 +26,14 @@ type Reservation struct {
 	SheetRank      string `json:"sheet_rank,omitempty"`
 	SheetNum       int64  `json:"sheet_num,omitempty"`
 	Price          int64  `json:"price,omitempty"`
+	Discount       int64  `json:"discount,omitempty"`
 	ReservedAtUnix int64  `json:"reserved_at,omitempty"`
 	CanceledAtUnix int64  `json:"canceled_at,omitempty"`
+	TicketCode     string `json:"ticket_code,omitempty"`
 }
 
-var reserveIDKey = "rid"
-
-func reserveKey(eventID int64, rank string) string {
-	return fmt.Sprintf("r_%v_%v", eventID, rank)
-}
+// maxReserveCount は1回の予約で取れる席数の上限
+const maxReserveCount = 10
 
 func postReserve(c echo.Context) error {
 	ctx := c.Request().Context()
@@ -45,10 +44,27 @@ func postReserve(c echo.Context) error {
 		return resError(c, "not_found", 404)
 	}
 	var params struct {
-		Rank string `json:"sheet_rank"`
+		Rank      string   `json:"sheet_rank"`
+		Ranks     []string `json:"sheet_ranks"`
+		Count     int      `json:"count"`
+		PromoCode string   `json:"promo_code"`
 	}
 	c.Bind(&params)
 
+	// sliceを作る前に席数を確かめる
+	if params.Count < 0 || params.Count > maxReserveCount || len(params.Ranks) > maxReserveCount {
+		return resError(c, "invalid_count", 400)
+	}
+	ranks := params.Ranks
+	if len(ranks) == 0 {
+		if params.Count == 0 {
+			params.Count = 1
+		}
+		for i := 0; i < params.Count; i++ {
+			ranks = append(ranks, params.Rank)
+		}
+	}
+
 	user, err := getLoginUser(c)
 	if err != nil {
 		return err
@@ -63,70 +79,330 @@ func postReserve(c echo.Context) error {
 	} else if !event.PublicFg {
 		return resError(c, "invalid_event", 404)
 	}
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
+	}
 
-	if !validateRank(params.Rank) {
-		return resError(c, "invalid_rank", 400)
+	validated := make(map[string]bool)
+	for _, rank := range ranks {
+		if validated[rank] {
+			continue
+		}
+		if !validateRank(event.Venue, rank) {
+			return resError(c, "invalid_rank", 400)
+		}
+		validated[rank] = true
 	}
 
-	var sheet Sheet
-	var reservationID int64
-	for {
-		s, err := client.HGetAll(reserveKey(event.ID, params.Rank)).Result()
-		if err != nil {
+	var promo *PromoCode
+	if params.PromoCode != "" {
+		promo, err = getPromoCode(ctx, params.PromoCode)
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_promo_code", 400)
+		} else if err != nil {
 			return err
 		}
-		if len(s) == int(sheetMap[params.Rank].Num) {
-			return resError(c, "sold_out", 409)
+		if !promo.applicable(event, ranks, time.Now()) {
+			return resError(c, "invalid_promo_code", 400)
 		}
+	}
 
-		sheet = RandSheet(params.Rank, s)
-		if sheet.ID == 0 {
-			return resError(c, "sold_out", 409)
-		}
+	reservations, err := reserveSheets(ctx, event, user.ID, ranks, promo)
+	if err == errSoldOut {
+		return resError(c, "sold_out", 409)
+	} else if err == errLimitExceeded {
+		return resError(c, "limit_exceeded", 403)
+	} else if err == errPromoCodeExhausted {
+		return resError(c, "promo_code_exhausted", 403)
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(202, echo.Map{
+		"id":           reservations[0].ID,
+		"sheet_rank":   reservations[0].SheetRank,
+		"sheet_num":    reservations[0].SheetNum,
+		"reservations": reservations,
+	})
+}
+
+var errSoldOut = errors.New("sold out")
 
-		tx, err := db.Begin()
+// reserveSheets は ranks (予約する席のrankを席の数だけ並べたもの) の席をまとめて予約する。
+// 全席を確保できた場合のみ予約を作成し、1席でも足りなければerrSoldOutを返す。
+// promoがあれば対象の席を割り引く。
+func reserveSheets(ctx context.Context, event *Event, userID int64, ranks []string, promo *PromoCode) ([]*Reservation, error) {
+	for attempt := 1; ; attempt++ {
+		now := time.Now().UTC()
+		sheets, err := inventory.Claim(event.ID, event.Venue, event.Allocation, ranks, strconv.FormatInt(now.Unix(), 10))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		{
-			reservationID, err = client.Incr(reserveIDKey).Result()
-			if err != nil {
-				log.Println("failed to incr:", err)
+		reservations, err := insertReservations(ctx, event, userID, sheets, promo, now)
+		if err == nil {
+			return reservations, nil
+		}
+		releaseSheets(event.ID, sheets)
+		if err == errSheetRemoved && attempt < maxReserveAttempts {
+			// 会場のキャッシュが古かったので、読み直して選び直す
+			forgetVenue(event.VenueID)
+			if event.Venue, err = getVenue(ctx, event.VenueID); err != nil {
+				return nil, err
 			}
+			continue
+		}
+		// 古いidのブロックとの重複かデッドロックだけやり直す。DBが落ちているときなどは何度やっても失敗する
+		if !isRetryable(err) || attempt >= maxReserveAttempts {
+			return nil, err
 		}
+		log.Println("re-try: rollback by", err)
+	}
+}
 
-		now := time.Now().UTC()
-		{
-			client.HSet(reserveKey(event.ID, sheet.Rank), strconv.Itoa(int(sheet.Num)), now.Unix())
+const maxReserveAttempts = 3
+
+var errSheetRemoved = errors.New("sheet removed")
+
+// checkSheetsActive はsheetsが会場の編集で外されていないか確かめる。
+// 共有ロックを取るので、会場の編集がcommitされるまで待ってから確かめることになる。
+func checkSheetsActive(ctx context.Context, tx *sql.Tx, sheets []Sheet) error {
+	placeholders := make([]string, 0, len(sheets))
+	args := make([]interface{}, 0, len(sheets))
+	for _, sheet := range sheets {
+		placeholders = append(placeholders, "?")
+		args = append(args, sheet.ID)
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sheets WHERE id IN ("+strings.Join(placeholders, ", ")+") AND active_fg = 1 LOCK IN SHARE MODE", args...).Scan(&n); err != nil {
+		return err
+	}
+	if n < len(sheets) {
+		return errSheetRemoved
+	}
+	return nil
+}
+
+func insertReservations(ctx context.Context, event *Event, userID int64, sheets []Sheet, promo *PromoCode, now time.Time) ([]*Reservation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// 古い会場をキャッシュしているappが、会場の編集で外れた席を選んでいることがある
+	if err := checkSheetsActive(ctx, tx, sheets); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if event.MaxPerUser > 0 || event.MaxPerRank > 0 {
+		// 同じuserの予約を直列にするためにusersの行をロックしてから数える
+		var id int64
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+			tx.Rollback()
+			return nil, err
 		}
+		ranks := make([]string, 0, len(sheets))
+		for _, sheet := range sheets {
+			ranks = append(ranks, sheet.Rank)
+		}
+		if err := checkReservationLimit(ctx, tx, event, userID, ranks); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if promo != nil {
+		if err := usePromoCode(ctx, tx, promo); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
 
-		_, err = tx.ExecContext(ctx, "INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?, ?)", reservationID, event.ID, sheet.ID, user.ID, now.Format("2006-01-02 15:04:05.000000"))
+	reservations := make([]*Reservation, 0, len(sheets))
+	for _, sheet := range sheets {
+		reservationID, err := reservationIDs.Next(ctx)
 		if err != nil {
 			tx.Rollback()
-			log.Println("re-try: rollback by", err)
-			continue
+			return nil, err
 		}
+
+		// 後から価格が変わっても売れた価格が残るように、予約時の価格を持たせておく
+		price := event.chargePrice(sheet)
+		var discount int64
+		var promoCode string
+		if promo != nil {
+			discount = promo.discount(sheet.Rank, price)
+			promoCode = promo.Code
+		}
+		price -= discount
+		_, err = tx.ExecContext(ctx, "INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at, price, discount, promo_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", reservationID, event.ID, sheet.ID, userID, now.Format("2006-01-02 15:04:05.000000"), price, discount, promoCode)
 		if err != nil {
 			tx.Rollback()
-			log.Println("re-try: rollback by", err)
-			continue
+			// initialize前に借りていたidが他のappのidと重なった
+			if isDuplicateEntry(err) {
+				reservationIDs.Discard()
+			}
+			return nil, err
 		}
-		if err := tx.Commit(); err != nil {
-			tx.Rollback()
-			log.Println("re-try: rollback by", err)
-			continue
+		reservations = append(reservations, &Reservation{
+			ID:        reservationID,
+			EventID:   event.ID,
+			SheetID:   sheet.ID,
+			UserID:    userID,
+			SheetRank: sheet.Rank,
+			SheetNum:  sheet.Num,
+			Price:     price,
+			Discount:  discount,
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	activities := make([]*ReservationActivity, 0, len(reservations))
+	for _, r := range reservations {
+		activities = append(activities, &ReservationActivity{Type: "reserve", EventID: r.EventID, ReservationID: r.ID, UserID: r.UserID, SheetRank: r.SheetRank, SheetNum: r.SheetNum, At: now.Unix()})
+	}
+	publishActivities(activities)
+	return reservations, nil
+}
+
+var errLimitExceeded = errors.New("limit exceeded")
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// checkReservationLimit はuserがeventで予約済みの席にranksの席を足しても
+// eventの1人あたりの上限とrankごとの上限を超えないか確かめる。
+func checkReservationLimit(ctx context.Context, q queryer, event *Event, userID int64, ranks []string) error {
+	if event.MaxPerUser == 0 && event.MaxPerRank == 0 {
+		return nil
+	}
+	rows, err := q.QueryContext(ctx, "SELECT sheet_id FROM reservations WHERE event_id = ? AND user_id = ? AND canceled_at IS NULL", event.ID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	total := len(ranks)
+	counts := make(map[string]int)
+	for _, rank := range ranks {
+		counts[rank]++
+	}
+	for rows.Next() {
+		var sheetID int64
+		if err := rows.Scan(&sheetID); err != nil {
+			return err
+		}
+		counts[sheetByID(sheetID).Rank]++
+		total++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if event.MaxPerUser > 0 && total > event.MaxPerUser {
+		return errLimitExceeded
+	}
+	if event.MaxPerRank > 0 {
+		for _, count := range counts {
+			if count > event.MaxPerRank {
+				return errLimitExceeded
+			}
+		}
+	}
+	return nil
+}
+
+func postSheetReservation(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postSheetReservation")
+	defer span.End()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	rank := c.Param("rank")
+	num, _ := strconv.ParseInt(c.Param("num"), 10, 64)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	event, err := getEvent(ctx, eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
 		}
+		return err
+	} else if !event.PublicFg {
+		return resError(c, "invalid_event", 404)
+	}
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
+	}
+
+	if !validateRank(event.Venue, rank) {
+		return resError(c, "invalid_rank", 404)
+	}
+
+	sheet, ok := event.Venue.Rank(rank).Sheet(num)
+	if !ok {
+		return resError(c, "invalid_sheet", 404)
+	}
 
-		break
+	reservation, err := reserveSheet(ctx, event, user.ID, sheet)
+	if err == errSheetTaken {
+		return resError(c, "sheet_taken", 409)
+	} else if err == errSheetRemoved {
+		forgetVenue(event.VenueID)
+		return resError(c, "invalid_sheet", 404)
+	} else if err == errLimitExceeded {
+		return resError(c, "limit_exceeded", 403)
+	} else if err != nil {
+		return err
 	}
 	return c.JSON(202, echo.Map{
-		"id":         reservationID,
-		"sheet_rank": params.Rank,
-		"sheet_num":  sheet.Num,
+		"id":         reservation.ID,
+		"sheet_rank": reservation.SheetRank,
+		"sheet_num":  reservation.SheetNum,
 	})
 }
 
+var errSheetTaken = errors.New("sheet taken")
+
+// reserveSheet は指定された1席を予約する。
+// inventoryかDBのどちらかですでに予約されていればerrSheetTakenを返す。
+func reserveSheet(ctx context.Context, event *Event, userID int64, sheet Sheet) (*Reservation, error) {
+	now := time.Now().UTC()
+	claimed, err := inventory.ClaimSheet(event.ID, sheet, strconv.FormatInt(now.Unix(), 10))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errSheetTaken
+	}
+
+	// inventoryで空いていてもDBで予約済みなら取られている。その場合はinventoryの方が正しくなったので解放しない
+	var reservedID int64
+	err = db.QueryRowContext(ctx, "SELECT id FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL LIMIT 1", event.ID, sheet.ID).Scan(&reservedID)
+	if err == nil {
+		return nil, errSheetTaken
+	} else if err != sql.ErrNoRows {
+		releaseSheets(event.ID, []Sheet{sheet})
+		return nil, err
+	}
+
+	reservations, err := insertReservations(ctx, event, userID, []Sheet{sheet}, nil, now)
+	if err != nil {
+		releaseSheets(event.ID, []Sheet{sheet})
+		return nil, err
+	}
+	return reservations[0], nil
+}
+
 func deleteReservation(c echo.Context) error {
 	ctx := c.Request().Context()
 	ctx, span := trace.StartSpan(ctx, "deleteReservation")
@@ -136,7 +412,7 @@ func deleteReservation(c echo.Context) error {
 		return resError(c, "not_found", 404)
 	}
 	rank := c.Param("rank")
-	num := c.Param("num")
+	num, _ := strconv.ParseInt(c.Param("num"), 10, 64)
 
 	user, err := getLoginUser(c)
 	if err != nil {
@@ -152,17 +428,17 @@ func deleteReservation(c echo.Context) error {
 	} else if !event.PublicFg {
 		return resError(c, "invalid_event", 404)
 	}
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
+	}
 
-	if !validateRank(rank) {
+	if !validateRank(event.Venue, rank) {
 		return resError(c, "invalid_rank", 404)
 	}
 
-	var sheet Sheet
-	if err := db.QueryRowContext(ctx, "SELECT * FROM sheets WHERE `rank` = ? AND num = ?", rank, num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-		if err == sql.ErrNoRows {
-			return resError(c, "invalid_sheet", 404)
-		}
-		return err
+	sheet, ok := event.Venue.Rank(rank).Sheet(num)
+	if !ok {
+		return resError(c, "invalid_sheet", 404)
 	}
 
 	tx, err := db.Begin()
@@ -171,7 +447,7 @@ func deleteReservation(c echo.Context) error {
 	}
 
 	var reservation Reservation
-	if err := tx.QueryRowContext(ctx, "SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
+	if err := tx.QueryRowContext(ctx, "SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
 		tx.Rollback()
 		if err == sql.ErrNoRows {
 			return resError(c, "not_reserved", 400)
@@ -183,7 +459,8 @@ func deleteReservation(c echo.Context) error {
 		return resError(c, "not_permitted", 403)
 	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET canceled_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -191,57 +468,125 @@ func deleteReservation(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return err
 	}
+	publishActivities([]*ReservationActivity{{Type: "cancel", EventID: event.ID, ReservationID: reservation.ID, UserID: user.ID, SheetRank: sheet.Rank, SheetNum: sheet.Num, At: now.Unix()}})
 
-	if err := client.HDel(reserveKey(event.ID, rank), strconv.Itoa(int(sheet.Num))).Err(); err != nil {
+	if err := freeSheets(event.ID, []Sheet{sheet}); err != nil {
 		return err
 	}
 	return c.NoContent(204)
 }
 
-func Rank(sheetId int64) (string, int64) {
-	if sheetId <= 50 {
-		return "S", sheetId
+// postCancelReservations はイベントでのuserの予約をまとめてキャンセルする。
+// reservation_ids が空なら有効な予約を全てキャンセルする。1件でもキャンセルできなければ何もしない。
+func postCancelReservations(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postCancelReservations")
+	defer span.End()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
 	}
-	if sheetId <= 200 {
-		return "A", sheetId - 50
+	var params struct {
+		ReservationIDs []int64 `json:"reservation_ids"`
 	}
-	if sheetId <= 500 {
-		return "B", sheetId - 200
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
 	}
-	return "C", sheetId - 500
-}
 
-/*
-   rank : SABCのどれか
-   s : keyがすでに使われているNumをstringにしたもの
-*/
-func RandSheet(rank string, s map[string]string) Sheet {
-	r := make([]int, 0, sheetMap[rank].Num)
-	q := make([]int64, 0, sheetMap[rank].Num)
-	for k, _ := range s {
-		used, _ := strconv.Atoi(k)
-		r = append(r, used)
+	event, err := getEventBase(ctx, eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.PublicFg {
+		return resError(c, "invalid_event", 404)
+	}
+	if code := event.salesError(time.Now()); code != "" {
+		return resError(c, code, 403)
 	}
 
-	r = sort.IntSlice(r)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, sheet_id FROM reservations WHERE event_id = ? AND user_id = ? AND canceled_at IS NULL FOR UPDATE", event.ID, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var ids []int64
+	active := make(map[int64]int64)
+	for rows.Next() {
+		var id, sheetID int64
+		if err := rows.Scan(&id, &sheetID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		ids = append(ids, id)
+		active[id] = sheetID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	j := 0
-	for i := int64(1); i <= sheetMap[rank].Num; i++ {
-		if j < len(r) && i == int64(r[j]) {
-			j++
-		} else {
-			q = append(q, i)
+	if len(params.ReservationIDs) > 0 {
+		// 同じidが何度指定されても1件としてキャンセルする
+		ids = make([]int64, 0, len(params.ReservationIDs))
+		seen := make(map[int64]bool, len(params.ReservationIDs))
+		for _, id := range params.ReservationIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
 		}
 	}
-	sheet := Sheet{}
-	sheet.Rank = rank
-	sheet.Num = q[rand.Intn(len(q))]
-	sheet.ID = sheet.Num
-	for _, c := range "SABC" {
-		if string(c) == rank {
-			break
+	if len(ids) == 0 {
+		tx.Rollback()
+		return resError(c, "not_reserved", 400)
+	}
+
+	now := time.Now().UTC()
+	var sheets []Sheet
+	placeholders := make([]string, 0, len(ids))
+	args := []interface{}{now.Format("2006-01-02 15:04:05.000000")}
+	for _, id := range ids {
+		sheetID, ok := active[id]
+		if !ok {
+			tx.Rollback()
+			return resError(c, "not_reserved", 400)
 		}
-		sheet.ID += sheetMap[string(c)].Num
+		delete(active, id)
+		sheets = append(sheets, sheetByID(sheetID))
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
 	}
-	return sheet
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET canceled_at = ? WHERE id IN ("+strings.Join(placeholders, ", ")+")", args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	activities := make([]*ReservationActivity, 0, len(ids))
+	for i, id := range ids {
+		activities = append(activities, &ReservationActivity{Type: "cancel", EventID: event.ID, ReservationID: id, UserID: user.ID, SheetRank: sheets[i].Rank, SheetNum: sheets[i].Num, At: now.Unix()})
+	}
+	publishActivities(activities)
+
+	if err := freeSheets(event.ID, sheets); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{
+		"canceled": ids,
+	})
 }
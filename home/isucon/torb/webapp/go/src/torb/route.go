@@ -12,12 +12,22 @@ func registerRoutes(e *echo.Echo) {
 	e.GET("/initialize", getInitialize)
 	e.POST("/api/users", postAPIUsers)
 	e.GET("/api/users/:id", getAPIUser, loginRequired)
+	e.GET("/api/users/:id/reservations", getAPIUserReservations, loginRequired)
 	e.POST("/api/actions/login", postActionsLogin)
 	e.POST("/api/actions/logout", postActionsLogout, loginRequired)
 	e.GET("/api/events", getAPIEvents)
 	e.GET("/api/events/:id", getAPIEvent)
-	e.POST("/api/events/:id/actions/reserve", postReserve, loginRequired)
-	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", deleteReservation, loginRequired)
+	e.GET("/api/events/:id/stream", getAPIEventStream, redisRequired)
+	e.POST("/api/events/:id/actions/reserve", postReserve, loginRequired, idempotent)
+	e.POST("/api/events/:id/actions/hold", postHold, loginRequired, redisRequired)
+	e.POST("/api/events/:id/waitlist", postWaitlist, loginRequired, redisRequired)
+	e.DELETE("/api/events/:id/waitlist/:rank", deleteWaitlist, loginRequired, redisRequired)
+	e.POST("/api/holds/:id/actions/confirm", postHoldConfirm, loginRequired, idempotent)
+	e.DELETE("/api/holds/:id", deleteHold, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/:num/reservation", postSheetReservation, loginRequired, idempotent)
+	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", deleteReservation, loginRequired, idempotent)
+	e.POST("/api/events/:id/actions/cancel", postCancelReservations, loginRequired, idempotent)
+	e.POST("/api/reservations/:id/actions/transfer", postTransfer, loginRequired)
 	registerAdminRoutes(e)
 }
 
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// EventTransition はスケジュールによって自動で行われたイベントの公開や終了の記録。
+// Action は publish, unpublish, close のどれか。
+type EventTransition struct {
+	ID             int64      `json:"id"`
+	EventID        int64      `json:"event_id"`
+	Action         string     `json:"action"`
+	ScheduledAt    *time.Time `json:"-"`
+	TransitionedAt *time.Time `json:"-"`
+
+	ScheduledAtUnix    int64 `json:"scheduled_at"`
+	TransitionedAtUnix int64 `json:"transitioned_at"`
+}
+
+var (
+	scheduleLockKey  = "schedule_lock"
+	scheduleInterval = 10 * time.Second
+)
+
+func scheduleLoop() {
+	for range time.Tick(scheduleInterval) {
+		// 複数台のappで同時に走らないようにする
+		if !tryLock(scheduleLockKey, scheduleInterval/2) {
+			continue
+		}
+		if err := runSchedule(context.Background(), time.Now()); err != nil {
+			log.Println("failed to run schedule:", err)
+		}
+	}
+}
+
+// runSchedule はpublish_atやclose_atを過ぎたイベントを公開、終了する。
+// 実行したスケジュールは消すので、あとから手で戻しても再び実行されることはない。
+func runSchedule(ctx context.Context, now time.Time) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM events WHERE publish_at <= ? OR close_at <= ?", now.UTC(), now.UTC())
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := transitionEvent(ctx, id, now); err != nil {
+			log.Printf("failed to transition event %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// transitionEvent はイベントのスケジュールを実行する。
+// 止まっていたなどでpublish_atとclose_atの両方を過ぎていても、飛ばさずに公開してから非公開、終了の順に行う。
+func transitionEvent(ctx context.Context, eventID int64, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var publicFg, closedFg bool
+	var publishAt, closeAt *time.Time
+	if err := tx.QueryRowContext(ctx, "SELECT public_fg, closed_fg, publish_at, close_at FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&publicFg, &closedFg, &publishAt, &closeAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	record := func(action string, scheduledAt *time.Time) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO event_transitions (event_id, action, scheduled_at, transitioned_at) VALUES (?, ?, ?, ?)", eventID, action, scheduledAt, now.UTC().Format("2006-01-02 15:04:05.000000"))
+		return err
+	}
+
+	if publishAt != nil && !now.Before(*publishAt) {
+		if !publicFg && !closedFg {
+			if _, err := tx.ExecContext(ctx, "UPDATE events SET public_fg = 1 WHERE id = ?", eventID); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := record("publish", publishAt); err != nil {
+				tx.Rollback()
+				return err
+			}
+			publicFg = true
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE events SET publish_at = NULL WHERE id = ?", eventID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if closeAt != nil && !now.Before(*closeAt) {
+		if !closedFg {
+			// 公開中のイベントはそのまま終了できないので、先に非公開にする
+			if publicFg {
+				if _, err := tx.ExecContext(ctx, "UPDATE events SET public_fg = 0 WHERE id = ?", eventID); err != nil {
+					tx.Rollback()
+					return err
+				}
+				if err := record("unpublish", closeAt); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE events SET closed_fg = 1 WHERE id = ?", eventID); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := record("close", closeAt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE events SET publish_at = NULL, close_at = NULL WHERE id = ?", eventID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func getAdminEventTransitions(c echo.Context) error {
+	ctx := c.Request().Context()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	if _, err := getEventBase(ctx, eventID); err == sql.ErrNoRows {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, event_id, action, scheduled_at, transitioned_at FROM event_transitions WHERE event_id = ? ORDER BY id ASC", eventID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	transitions := make([]EventTransition, 0)
+	for rows.Next() {
+		var t EventTransition
+		if err := rows.Scan(&t.ID, &t.EventID, &t.Action, &t.ScheduledAt, &t.TransitionedAt); err != nil {
+			return err
+		}
+		t.ScheduledAtUnix = unixOrZero(t.ScheduledAt)
+		t.TransitionedAtUnix = unixOrZero(t.TransitionedAt)
+		transitions = append(transitions, t)
+	}
+	return c.JSON(200, transitions)
+}
@@ -17,29 +17,7 @@ type Sheet struct {
 
 	Mine           bool       `json:"mine,omitempty"`
 	Reserved       bool       `json:"reserved,omitempty"`
+	Held           bool       `json:"held,omitempty"`
 	ReservedAt     *time.Time `json:"-"`
 	ReservedAtUnix int64      `json:"reserved_at,omitempty"`
 }
-
-var sheetMap = map[string]Sheet{
-	"A": Sheet{
-		Rank:  "A",
-		Num:   150,
-		Price: 3000,
-	},
-	"B": Sheet{
-		Rank:  "B",
-		Num:   300,
-		Price: 1000,
-	},
-	"C": Sheet{
-		Rank:  "C",
-		Num:   500,
-		Price: 0,
-	},
-	"S": Sheet{
-		Rank:  "S",
-		Num:   50,
-		Price: 5000,
-	},
-}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/labstack/echo"
+)
+
+// ticketSecret は起動時にTICKET_SECRETから読む
+var ticketSecret []byte
+
+// ticketSignature は持ち主のuserも含めて署名するので、譲渡すると前の持ち主のコードは使えなくなる。
+func ticketSignature(reservationID, eventID, sheetID, userID int64) string {
+	mac := hmac.New(sha256.New, ticketSecret)
+	fmt.Fprintf(mac, "%d:%d:%d:%d", reservationID, eventID, sheetID, userID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ticketCode は入場時に読み取る "<reservation id>.<署名>" 形式のコード
+func ticketCode(r *Reservation) string {
+	return fmt.Sprintf("%d.%s", r.ID, ticketSignature(r.ID, r.EventID, r.SheetID, r.UserID))
+}
+
+func parseTicketCode(code string) (int64, string, bool) {
+	v := strings.SplitN(code, ".", 2)
+	if len(v) != 2 {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return id, v[1], true
+}
+
+func postAdminCheckIn(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postAdminCheckIn")
+	defer span.End()
+	var params struct {
+		Code string `json:"code"`
+	}
+	c.Bind(&params)
+
+	reservationID, signature, ok := parseTicketCode(params.Code)
+	if !ok {
+		return resError(c, "invalid_ticket", 400)
+	}
+
+	var reservation Reservation
+	var checkedInAt *time.Time
+	if err := db.QueryRowContext(ctx, "SELECT id, event_id, sheet_id, user_id, canceled_at, checked_in_at FROM reservations WHERE id = ?", reservationID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.CanceledAt, &checkedInAt); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_ticket", 400)
+		}
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(ticketSignature(reservation.ID, reservation.EventID, reservation.SheetID, reservation.UserID))) {
+		return resError(c, "invalid_ticket", 400)
+	}
+	if reservation.CanceledAt != nil {
+		return resError(c, "ticket_canceled", 400)
+	}
+	if checkedInAt != nil {
+		return resError(c, "already_checked_in", 409)
+	}
+
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, "UPDATE reservations SET checked_in_at = ? WHERE id = ? AND canceled_at IS NULL AND checked_in_at IS NULL", now.Format("2006-01-02 15:04:05.000000"), reservation.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "already_checked_in", 409)
+	}
+
+	sheet := sheetByID(reservation.SheetID)
+	return c.JSON(200, echo.Map{
+		"reservation_id": reservation.ID,
+		"event_id":       reservation.EventID,
+		"user_id":        reservation.UserID,
+		"sheet_rank":     sheet.Rank,
+		"sheet_num":      sheet.Num,
+		"checked_in_at":  now.Unix(),
+	})
+}
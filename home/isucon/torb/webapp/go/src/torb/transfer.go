@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/labstack/echo"
+)
+
+type Transfer struct {
+	ID            int64      `json:"id"`
+	ReservationID int64      `json:"reservation_id"`
+	FromUserID    int64      `json:"from_user_id"`
+	ToUserID      int64      `json:"to_user_id"`
+	TransferredAt *time.Time `json:"-"`
+
+	TransferredAtUnix int64 `json:"transferred_at"`
+}
+
+// postTransfer は予約を別のuserに譲渡する。席は変わらないのでinventoryには触らない。
+func postTransfer(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postTransfer")
+	defer span.End()
+	reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		LoginName string `json:"login_name"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	var to User
+	if err := db.QueryRowContext(ctx, "SELECT id, nickname FROM users WHERE login_name = ?", params.LoginName).Scan(&to.ID, &to.Nickname); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "user_not_found", 404)
+		}
+		return err
+	}
+	if to.ID == user.ID {
+		return resError(c, "invalid_recipient", 400)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var reservation Reservation
+	if err := tx.QueryRowContext(ctx, "SELECT id, event_id, sheet_id, user_id FROM reservations WHERE id = ? AND canceled_at IS NULL FOR UPDATE", reservationID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "not_reserved", 400)
+		}
+		return err
+	}
+	if reservation.UserID != user.ID {
+		tx.Rollback()
+		return resError(c, "not_permitted", 403)
+	}
+
+	event, err := getEventBase(ctx, reservation.EventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !event.PublicFg {
+		tx.Rollback()
+		return resError(c, "invalid_event", 404)
+	}
+
+	// 譲渡先のuserも予約と同じく上限を超えないようにする
+	if event.MaxPerUser > 0 || event.MaxPerRank > 0 {
+		var id int64
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = ? FOR UPDATE", to.ID).Scan(&id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := checkReservationLimit(ctx, tx, event, to.ID, []string{sheetByID(reservation.SheetID).Rank}); err != nil {
+			tx.Rollback()
+			if err == errLimitExceeded {
+				return resError(c, "limit_exceeded", 403)
+			}
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, "UPDATE reservations SET user_id = ? WHERE id = ?", to.ID, reservation.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO reservation_transfers (reservation_id, from_user_id, to_user_id, transferred_at) VALUES (?, ?, ?, ?)", reservation.ID, user.ID, to.ID, now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	transferID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(200, Transfer{
+		ID:                transferID,
+		ReservationID:     reservation.ID,
+		FromUserID:        user.ID,
+		ToUserID:          to.ID,
+		TransferredAtUnix: now.Unix(),
+	})
+}
+
+func getAdminTransfers(c echo.Context) error {
+	ctx := c.Request().Context()
+	reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, reservation_id, from_user_id, to_user_id, transferred_at FROM reservation_transfers WHERE reservation_id = ? ORDER BY id ASC", reservationID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	transfers := make([]Transfer, 0)
+	for rows.Next() {
+		var transfer Transfer
+		if err := rows.Scan(&transfer.ID, &transfer.ReservationID, &transfer.FromUserID, &transfer.ToUserID, &transfer.TransferredAt); err != nil {
+			return err
+		}
+		transfer.TransferredAtUnix = transfer.TransferredAt.Unix()
+		transfers = append(transfers, transfer)
+	}
+	return c.JSON(200, transfers)
+}
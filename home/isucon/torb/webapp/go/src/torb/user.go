@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
@@ -98,6 +105,34 @@ func postAPIUsers(c echo.Context) error {
 	})
 }
 
+// fillReservation はAPIで返すためにreservationにイベントと席を詰める。価格は予約時のものをそのまま返す。
+// events は同じイベントを何度も引かないためのキャッシュ。
+func fillReservation(ctx context.Context, reservation *Reservation, sheet Sheet, events map[int64]*Event) error {
+	event, ok := events[reservation.EventID]
+	if !ok {
+		var err error
+		event, err = getEventLightSheets(ctx, reservation.EventID, -1)
+		if err != nil {
+			return err
+		}
+		events[reservation.EventID] = event
+	}
+	light := *event
+	light.Sheets = nil
+	light.Total = 0
+	light.Remains = 0
+
+	reservation.Event = &light
+	reservation.SheetRank = sheet.Rank
+	reservation.SheetNum = sheet.Num
+	reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
+	reservation.TicketCode = ticketCode(reservation)
+	if reservation.CanceledAt != nil {
+		reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+	}
+	return nil
+}
+
 func getAPIUser(c echo.Context) error {
 	var user User
 	ctx := c.Request().Context()
@@ -113,37 +148,24 @@ func getAPIUser(c echo.Context) error {
 		return resError(c, "forbidden", 403)
 	}
 
-	rows, err := db.QueryContext(ctx, "SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC LIMIT 5", user.ID)
+	rows, err := db.QueryContext(ctx, "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, r.price, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC, r.id DESC LIMIT 5", user.ID)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	events := make(map[int64]*Event)
 	var recentReservations []Reservation
 	for rows.Next() {
 		var reservation Reservation
 		var sheet Sheet
-		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num); err != nil {
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &sheet.Rank, &sheet.Num); err != nil {
 			return err
 		}
 
-		event, err := getEventLightSheets(ctx, reservation.EventID, -1)
-		if err != nil {
+		if err := fillReservation(ctx, &reservation, sheet, events); err != nil {
 			return err
 		}
-		price := event.Sheets[sheet.Rank].Price
-		event.Sheets = nil
-		event.Total = 0
-		event.Remains = 0
-
-		reservation.Event = event
-		reservation.SheetRank = sheet.Rank
-		reservation.SheetNum = sheet.Num
-		reservation.Price = price
-		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-		if reservation.CanceledAt != nil {
-			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
-		}
 		recentReservations = append(recentReservations, reservation)
 	}
 	if recentReservations == nil {
@@ -151,7 +173,7 @@ func getAPIUser(c echo.Context) error {
 	}
 
 	var totalPrice int
-	if err := db.QueryRowContext(ctx, "SELECT IFNULL(SUM(e.price + s.price), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.user_id = ? AND r.canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
+	if err := db.QueryRowContext(ctx, "SELECT IFNULL(SUM(price), 0) FROM reservations WHERE user_id = ? AND canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
 		return err
 	}
 
@@ -180,11 +202,149 @@ func getAPIUser(c echo.Context) error {
 		recentEvents = make([]*Event, 0)
 	}
 
+	waitlists, err := userWaitlists(user.ID)
+	if err != nil {
+		return err
+	}
+	holds, err := userHolds(user.ID)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(200, echo.Map{
 		"id":                  user.ID,
 		"nickname":            user.Nickname,
 		"recent_reservations": recentReservations,
 		"total_price":         totalPrice,
 		"recent_events":       recentEvents,
+		"waitlists":           waitlists,
+		"holds":               holds,
+	})
+}
+
+func getAPIUserReservations(c echo.Context) error {
+	var user User
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "getAPIUserReservations")
+	defer span.End()
+	if err := db.QueryRowContext(ctx, "SELECT id, nickname FROM users WHERE id = ?", c.Param("id")).Scan(&user.ID, &user.Nickname); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+
+	loginUser, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	if user.ID != loginUser.ID {
+		return resError(c, "forbidden", 403)
+	}
+
+	query := "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, r.price, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ?"
+	args := []interface{}{user.ID}
+
+	limit := 20
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 100 {
+			return resError(c, "invalid_limit", 400)
+		}
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		reservedAt, id, ok := parseReservationCursor(v)
+		if !ok {
+			return resError(c, "invalid_cursor", 400)
+		}
+		query += " AND (r.reserved_at < ? OR (r.reserved_at = ? AND r.id < ?))"
+		args = append(args, reservedAt, reservedAt, id)
+	}
+	switch c.QueryParam("status") {
+	case "":
+	case "active":
+		query += " AND r.canceled_at IS NULL"
+	case "canceled":
+		query += " AND r.canceled_at IS NOT NULL"
+	default:
+		return resError(c, "invalid_status", 400)
+	}
+	if v := c.QueryParam("event_id"); v != "" {
+		eventID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return resError(c, "invalid_event", 400)
+		}
+		query += " AND r.event_id = ?"
+		args = append(args, eventID)
+	}
+	for _, f := range []struct{ param, cond string }{
+		{"from", " AND r.reserved_at >= ?"},
+		{"to", " AND r.reserved_at < ?"},
+	} {
+		v := c.QueryParam(f.param)
+		if v == "" {
+			continue
+		}
+		unix, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return resError(c, "invalid_"+f.param, 400)
+		}
+		query += f.cond
+		args = append(args, time.Unix(unix, 0).UTC().Format("2006-01-02 15:04:05.000000"))
+	}
+	// idはappごとにブロックで払い出すので、idの順は予約した順にならない
+	query += " ORDER BY r.reserved_at DESC, r.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	events := make(map[int64]*Event)
+	reservations := make([]Reservation, 0, limit)
+	var nextCursor *string
+	for rows.Next() {
+		var reservation Reservation
+		var sheet Sheet
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &sheet.Rank, &sheet.Num); err != nil {
+			return err
+		}
+		if len(reservations) == limit {
+			cursor := reservationCursor(&reservations[limit-1])
+			nextCursor = &cursor
+			break
+		}
+		if err := fillReservation(ctx, &reservation, sheet, events); err != nil {
+			return err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return c.JSON(200, echo.Map{
+		"reservations": reservations,
+		"next_cursor":  nextCursor,
 	})
 }
+
+// reservationCursor は予約一覧の続きを読むためのcursorを作る。予約の reserved_at (マイクロ秒) と id を _ でつなぐ。
+func reservationCursor(r *Reservation) string {
+	return fmt.Sprintf("%d_%d", r.ReservedAt.UnixNano()/int64(time.Microsecond), r.ID)
+}
+
+func parseReservationCursor(v string) (string, int64, bool) {
+	parts := strings.Split(v, "_")
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	micro, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	reservedAt := time.Unix(0, micro*int64(time.Microsecond)).UTC()
+	return reservedAt.Format("2006-01-02 15:04:05.000000"), id, true
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Venue は会場の席の配置。イベントは作成時に会場を1つ選び、その会場の席を売る。
+type Venue struct {
+	ID       int64        `json:"id"`
+	Name     string       `json:"name"`
+	Address  string       `json:"address"`
+	Capacity int64        `json:"capacity"`
+	Ranks    []*VenueRank `json:"ranks"`
+}
+
+// VenueRank は会場のrankごとの席。rows行columns列に並んでいて、Sheets[num-1] がnum番の席。
+type VenueRank struct {
+	Rank    string  `json:"rank"`
+	Num     int64   `json:"num"`
+	Price   int64   `json:"price"`
+	Rows    int64   `json:"rows"`
+	Columns int64   `json:"columns"`
+	Sheets  []Sheet `json:"-"`
+}
+
+const defaultVenueID = 1
+
+// venueUpdatedChannel には変更された会場のidが流れる。各appはキャッシュを捨てる。
+var venueUpdatedChannel = "venue_updated"
+
+var venues = struct {
+	sync.RWMutex
+	byID    map[int64]*Venue
+	byEvent map[int64]int64
+	sheets  map[int64]Sheet
+}{
+	byID:    make(map[int64]*Venue),
+	byEvent: make(map[int64]int64),
+	sheets:  make(map[int64]Sheet),
+}
+
+func (v *Venue) Rank(rank string) *VenueRank {
+	for _, r := range v.Ranks {
+		if r.Rank == rank {
+			return r
+		}
+	}
+	return nil
+}
+
+func (v *Venue) RankNames() []string {
+	names := make([]string, 0, len(v.Ranks))
+	for _, r := range v.Ranks {
+		names = append(names, r.Rank)
+	}
+	return names
+}
+
+// Sheet はnum番の席を返す。
+func (r *VenueRank) Sheet(num int64) (Sheet, bool) {
+	if num < 1 || num > int64(len(r.Sheets)) {
+		return Sheet{}, false
+	}
+	return r.Sheets[num-1], true
+}
+
+func (r *VenueRank) SheetsOf(nums []int64) []Sheet {
+	sheets := make([]Sheet, 0, len(nums))
+	for _, num := range nums {
+		sheet, _ := r.Sheet(num)
+		sheets = append(sheets, sheet)
+	}
+	return sheets
+}
+
+func loadVenue(ctx context.Context, venueID int64) (*Venue, error) {
+	venue := &Venue{ID: venueID}
+	if err := db.QueryRowContext(ctx, "SELECT name, address FROM venues WHERE id = ?", venueID).Scan(&venue.Name, &venue.Address); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT `rank`, price, `rows`, `columns` FROM venue_ranks WHERE venue_id = ? ORDER BY position ASC", venueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r VenueRank
+		if err := rows.Scan(&r.Rank, &r.Price, &r.Rows, &r.Columns); err != nil {
+			return nil, err
+		}
+		venue.Ranks = append(venue.Ranks, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT id, `rank`, num, price FROM sheets WHERE venue_id = ? AND active_fg = 1 ORDER BY num ASC", venueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sheet Sheet
+		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
+			return nil, err
+		}
+		if r := venue.Rank(sheet.Rank); r != nil {
+			r.Sheets = append(r.Sheets, sheet)
+			r.Num++
+			venue.Capacity++
+		}
+	}
+	return venue, rows.Err()
+}
+
+// getVenue は会場をキャッシュから返す。なければDBから読む。
+func getVenue(ctx context.Context, venueID int64) (*Venue, error) {
+	venues.RLock()
+	venue, ok := venues.byID[venueID]
+	venues.RUnlock()
+	if ok {
+		return venue, nil
+	}
+
+	venue, err := loadVenue(ctx, venueID)
+	if err != nil {
+		return nil, err
+	}
+	venues.Lock()
+	venues.byID[venueID] = venue
+	for _, r := range venue.Ranks {
+		for _, sheet := range r.Sheets {
+			venues.sheets[sheet.ID] = sheet
+		}
+	}
+	venues.Unlock()
+	return venue, nil
+}
+
+// resetVenues はキャッシュを捨てて全ての会場を読み直す。
+func resetVenues(ctx context.Context) error {
+	venues.Lock()
+	venues.byID = make(map[int64]*Venue)
+	venues.byEvent = make(map[int64]int64)
+	venues.sheets = make(map[int64]Sheet)
+	venues.Unlock()
+
+	rows, err := db.QueryContext(ctx, "SELECT id FROM venues")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := getVenue(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// venueOfEvent はイベントの会場を返す。イベントの会場はあとから変わらないのでキャッシュしておく。
+func venueOfEvent(ctx context.Context, eventID int64) (*Venue, error) {
+	venues.RLock()
+	venueID, ok := venues.byEvent[eventID]
+	venues.RUnlock()
+	if !ok {
+		if err := db.QueryRowContext(ctx, "SELECT venue_id FROM events WHERE id = ?", eventID).Scan(&venueID); err != nil {
+			return nil, err
+		}
+		venues.Lock()
+		venues.byEvent[eventID] = venueID
+		venues.Unlock()
+	}
+	return getVenue(ctx, venueID)
+}
+
+// sheetByID はsheet idから席を引く。席のrankとnumはあとから変わらない。
+func sheetByID(sheetID int64) Sheet {
+	venues.RLock()
+	sheet, ok := venues.sheets[sheetID]
+	venues.RUnlock()
+	if ok {
+		return sheet
+	}
+
+	if err := db.QueryRow("SELECT id, `rank`, num, price FROM sheets WHERE id = ?", sheetID).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("failed to get sheet:", err)
+		}
+		return Sheet{ID: sheetID}
+	}
+	venues.Lock()
+	venues.sheets[sheetID] = sheet
+	venues.Unlock()
+	return sheet
+}
+
+// forgetVenue はこのappの会場のキャッシュを捨てる。
+func forgetVenue(venueID int64) {
+	venues.Lock()
+	delete(venues.byID, venueID)
+	venues.Unlock()
+}
+
+// invalidateVenue は会場のキャッシュを全てのappで捨てる。
+func invalidateVenue(venueID int64) {
+	forgetVenue(venueID)
+	if !redisEnabled() {
+		return
+	}
+	if err := client.Publish(venueUpdatedChannel, venueID).Err(); err != nil {
+		log.Println("failed to publish venue update:", err)
+	}
+}
+
+func watchVenues() {
+	pubsub := client.Subscribe(venueUpdatedChannel)
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		venueID, err := strconv.ParseInt(msg.Payload, 10, 64)
+		if err != nil {
+			continue
+		}
+		forgetVenue(venueID)
+	}
+}
+
+// redisのkeyに入れるので区切りの _ などは使えない
+var rankNamePattern = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+type venueParams struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Ranks   []struct {
+		Rank    string `json:"rank"`
+		Price   int64  `json:"price"`
+		Rows    int64  `json:"rows"`
+		Columns int64  `json:"columns"`
+	} `json:"ranks"`
+}
+
+// maxVenueCapacity は1つの会場に置ける席の数の上限。席は1回の編集で全てsheetsに入れるので大きくしすぎない。
+const maxVenueCapacity = 10000
+
+func (p *venueParams) validate() bool {
+	if p.Name == "" || len(p.Ranks) == 0 {
+		return false
+	}
+	seen := make(map[string]bool)
+	var capacity int64
+	for _, r := range p.Ranks {
+		if !rankNamePattern.MatchString(r.Rank) || seen[r.Rank] {
+			return false
+		}
+		if r.Price < 0 || r.Rows <= 0 || r.Columns <= 0 || r.Rows > maxVenueCapacity || r.Columns > maxVenueCapacity {
+			return false
+		}
+		capacity += r.Rows * r.Columns
+		if capacity > maxVenueCapacity {
+			return false
+		}
+		seen[r.Rank] = true
+	}
+	return true
+}
+
+// removedSheets はvenueをparamsの配置にしたときになくなる席を返す。
+func removedSheets(venue *Venue, params *venueParams) []Sheet {
+	var removed []Sheet
+	for _, vr := range venue.Ranks {
+		n := int64(0)
+		for _, r := range params.Ranks {
+			if r.Rank == vr.Rank {
+				n = r.Rows * r.Columns
+			}
+		}
+		if n < vr.Num {
+			removed = append(removed, vr.Sheets[n:]...)
+		}
+	}
+	return removed
+}
+
+// openVenueEvents は会場を使っている終わっていないイベントのidを返す。
+// 終わったイベントの席はもう売らないので、会場の席を減らしても構わない。
+func openVenueEvents(ctx context.Context, venueID int64) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM events WHERE venue_id = ? AND closed_fg = 0", venueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var eventIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, id)
+	}
+	return eventIDs, rows.Err()
+}
+
+// soldSheets はeventIDsのイベントでsheetsのうち予約か仮押さえで埋まっている席の数を返す。
+func soldSheets(ctx context.Context, eventIDs []int64, sheets []Sheet) (int, error) {
+	if len(eventIDs) == 0 || len(sheets) == 0 {
+		return 0, nil
+	}
+	eventPlaceholders := make([]string, 0, len(eventIDs))
+	args := make([]interface{}, 0, len(eventIDs)+len(sheets))
+	for _, id := range eventIDs {
+		eventPlaceholders = append(eventPlaceholders, "?")
+		args = append(args, id)
+	}
+	removed := make(map[int64]bool, len(sheets))
+	sheetPlaceholders := make([]string, 0, len(sheets))
+	for _, sheet := range sheets {
+		removed[sheet.ID] = true
+		sheetPlaceholders = append(sheetPlaceholders, "?")
+		args = append(args, sheet.ID)
+	}
+
+	var sold int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reservations WHERE canceled_at IS NULL AND event_id IN ("+strings.Join(eventPlaceholders, ", ")+") AND sheet_id IN ("+strings.Join(sheetPlaceholders, ", ")+")", args...).Scan(&sold); err != nil {
+		return 0, err
+	}
+	holds, err := eventHolds(eventIDs)
+	if err != nil {
+		return 0, err
+	}
+	for _, hold := range holds {
+		if removed[hold.SheetID] {
+			sold++
+		}
+	}
+	return sold, nil
+}
+
+// claimRemovedSheets はなくなる席をeventIDsのイベントのinventoryでまとめて確保して、編集の間に予約や仮押さえされないようにする。
+// 1席でも埋まっていれば確保した席を空けてfalseを返す。確保した席は会場の変更をcommitしたあとにreleaseRemovedSheetsで空ける。
+// なくなる席なのでstreamには流さない。
+func claimRemovedSheets(eventIDs []int64, sheets []Sheet) (claimed []int64, ok bool, err error) {
+	if len(sheets) == 0 {
+		return nil, true, nil
+	}
+	inv := silentInventory(inventory)
+	// reconcileにstaleとして消されないよう、予約と同じく時刻を入れておく
+	value := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, eventID := range eventIDs {
+		ok, err := inv.ClaimSheets(eventID, sheets, value)
+		if err != nil || !ok {
+			releaseRemovedSheets(claimed, sheets)
+			return nil, false, err
+		}
+		claimed = append(claimed, eventID)
+	}
+	return claimed, true, nil
+}
+
+func releaseRemovedSheets(eventIDs []int64, sheets []Sheet) {
+	inv := silentInventory(inventory)
+	for _, eventID := range eventIDs {
+		if err := inv.Release(eventID, sheets); err != nil {
+			log.Println("failed to release sheet:", err)
+		}
+	}
+}
+
+// saveVenueRanks は会場のrankと席をparamsの配置にする。
+// 減った席はactive_fgを0にして会場から外し、増えた席は外した席があれば付け直して、足りない分をsheetsに足す。
+// 外した席も過去の予約から参照されるので消さない。
+func saveVenueRanks(ctx context.Context, tx *sql.Tx, venueID int64, venue *Venue, params *venueParams) error {
+	keep := make(map[string]bool)
+	for i, r := range params.Ranks {
+		keep[r.Rank] = true
+		if _, err := tx.ExecContext(ctx, "INSERT INTO venue_ranks (venue_id, `rank`, price, position, `rows`, `columns`) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE price = VALUES(price), position = VALUES(position), `rows` = VALUES(`rows`), `columns` = VALUES(`columns`)", venueID, r.Rank, r.Price, i+1, r.Rows, r.Columns); err != nil {
+			return err
+		}
+
+		var current int64
+		if venue != nil {
+			if vr := venue.Rank(r.Rank); vr != nil {
+				current = vr.Num
+			}
+		}
+		n := r.Rows * r.Columns
+		if n < current {
+			if _, err := tx.ExecContext(ctx, "UPDATE sheets SET active_fg = 0 WHERE venue_id = ? AND `rank` = ? AND num > ?", venueID, r.Rank, n); err != nil {
+				return err
+			}
+		}
+		if n > current {
+			if _, err := tx.ExecContext(ctx, "UPDATE sheets SET active_fg = 1 WHERE venue_id = ? AND `rank` = ? AND num > ? AND num <= ?", venueID, r.Rank, current, n); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE sheets SET price = ? WHERE venue_id = ? AND `rank` = ? AND active_fg = 1", r.Price, venueID, r.Rank); err != nil {
+			return err
+		}
+		var last int64
+		if err := tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(num), 0) FROM sheets WHERE venue_id = ? AND `rank` = ?", venueID, r.Rank).Scan(&last); err != nil {
+			return err
+		}
+		if err := insertSheets(ctx, tx, venueID, r.Rank, r.Price, last+1, n); err != nil {
+			return err
+		}
+	}
+
+	if venue == nil {
+		return nil
+	}
+	for _, vr := range venue.Ranks {
+		if keep[vr.Rank] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM venue_ranks WHERE venue_id = ? AND `rank` = ?", venueID, vr.Rank); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE sheets SET active_fg = 0 WHERE venue_id = ? AND `rank` = ?", venueID, vr.Rank); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sheetsInsertBatch は1回のINSERTで入れる席の数
+const sheetsInsertBatch = 500
+
+// insertSheets はrankのfrom番からto番までの席をsheetsに入れる。
+func insertSheets(ctx context.Context, tx *sql.Tx, venueID int64, rank string, price int64, from, to int64) error {
+	for from <= to {
+		end := from + sheetsInsertBatch - 1
+		if end > to {
+			end = to
+		}
+		placeholders := make([]string, 0, end-from+1)
+		args := make([]interface{}, 0, (end-from+1)*4)
+		for num := from; num <= end; num++ {
+			placeholders = append(placeholders, "(?, ?, ?, ?)")
+			args = append(args, rank, num, price, venueID)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO sheets (`rank`, num, price, venue_id) VALUES "+strings.Join(placeholders, ", "), args...); err != nil {
+			return err
+		}
+		from = end + 1
+	}
+	return nil
+}
+
+func getAdminVenues(c echo.Context) error {
+	ctx := c.Request().Context()
+	rows, err := db.QueryContext(ctx, "SELECT id FROM venues ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	list := make([]*Venue, 0, len(ids))
+	for _, id := range ids {
+		venue, err := getVenue(ctx, id)
+		if err != nil {
+			return err
+		}
+		list = append(list, venue)
+	}
+	return c.JSON(200, list)
+}
+
+func getAdminVenue(c echo.Context) error {
+	venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	venue, err := getVenue(c.Request().Context(), venueID)
+	if err == sql.ErrNoRows {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(200, venue)
+}
+
+func postAdminVenue(c echo.Context) error {
+	ctx := c.Request().Context()
+	var params venueParams
+	c.Bind(&params)
+	if !params.validate() {
+		return resError(c, "invalid_venue", 400)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO venues (name, address) VALUES (?, ?)", params.Name, params.Address)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	venueID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveVenueRanks(ctx, tx, venueID, nil, &params); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	venue, err := getVenue(ctx, venueID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, venue)
+}
+
+// postAdminVenueEdit は会場の名前と配置を変える。
+// なくなる席に予約や仮押さえがあれば、売れた席より小さくはできないのでエラーにする。
+func postAdminVenueEdit(c echo.Context) error {
+	ctx := c.Request().Context()
+	venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params venueParams
+	c.Bind(&params)
+	if !params.validate() {
+		return resError(c, "invalid_venue", 400)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// 同じ会場の編集が同時に走らないようにする
+	var id int64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM venues WHERE id = ? FOR UPDATE", venueID).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+	venue, err := loadVenue(ctx, venueID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// 予約はinventoryで席を確保してからDBに入るので、なくなる席を先にinventoryで押さえてからDBを確かめる
+	removed := removedSheets(venue, &params)
+	eventIDs, err := openVenueEvents(ctx, venueID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	claimed, ok, err := claimRemovedSheets(eventIDs, removed)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !ok {
+		tx.Rollback()
+		return resError(c, "sheets_sold", 409)
+	}
+	// commitした後は、古い会場をキャッシュしているappが外した席を選んでもinsertReservationsで弾かれる
+	defer releaseRemovedSheets(claimed, removed)
+	sold, err := soldSheets(ctx, eventIDs, removed)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if sold > 0 {
+		tx.Rollback()
+		return resError(c, "sheets_sold", 409)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE venues SET name = ?, address = ? WHERE id = ?", params.Name, params.Address, venueID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveVenueRanks(ctx, tx, venueID, venue, &params); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateVenue(venueID)
+
+	venue, err = getVenue(ctx, venueID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, venue)
+}
+
+// deleteAdminVenue はどのイベントにも使われていない会場を消す。
+func deleteAdminVenue(c echo.Context) error {
+	ctx := c.Request().Context()
+	venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM venues WHERE id = ? FOR UPDATE", venueID).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+	var events int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM events WHERE venue_id = ?", venueID).Scan(&events); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if events > 0 {
+		tx.Rollback()
+		return resError(c, "venue_in_use", 409)
+	}
+
+	for _, q := range []string{
+		"DELETE FROM venue_ranks WHERE venue_id = ?",
+		"UPDATE sheets SET active_fg = 0 WHERE venue_id = ?",
+		"DELETE FROM venues WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, q, venueID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateVenue(venueID)
+	return c.NoContent(204)
+}
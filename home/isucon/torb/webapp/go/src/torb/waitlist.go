@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/trace"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+)
+
+// WaitlistEntry はイベントのrankごとのキャンセル待ちの1件。positionは1始まり。
+type WaitlistEntry struct {
+	EventID   int64  `json:"event_id"`
+	SheetRank string `json:"sheet_rank"`
+	UserID    int64  `json:"user_id,omitempty"`
+	Position  int64  `json:"position"`
+}
+
+var waitlistSeqKey = "wseq"
+
+// waitlistKey はuser idをmember、登録順をscoreに持つsorted set
+func waitlistKey(eventID int64, rank string) string {
+	return fmt.Sprintf("w_%v_%v", eventID, rank)
+}
+
+// userWaitlistsKey はuserが並んでいる "<event id>_<rank>" のset
+func userWaitlistsKey(userID int64) string {
+	return fmt.Sprintf("wu_%v", userID)
+}
+
+func joinWaitlist(eventID int64, rank string, userID int64) (int64, error) {
+	seq, err := client.Incr(waitlistSeqKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	member := strconv.FormatInt(userID, 10)
+	if err := client.ZAddNX(waitlistKey(eventID, rank), redis.Z{Score: float64(seq), Member: member}).Err(); err != nil {
+		return 0, err
+	}
+	if err := client.SAdd(userWaitlistsKey(userID), fmt.Sprintf("%v_%v", eventID, rank)).Err(); err != nil {
+		return 0, err
+	}
+	pos, err := client.ZRank(waitlistKey(eventID, rank), member).Result()
+	return pos + 1, err
+}
+
+func leaveWaitlist(eventID int64, rank string, userID int64) (bool, error) {
+	n, err := client.ZRem(waitlistKey(eventID, rank), strconv.FormatInt(userID, 10)).Result()
+	if err != nil {
+		return false, err
+	}
+	client.SRem(userWaitlistsKey(userID), fmt.Sprintf("%v_%v", eventID, rank))
+	return n > 0, nil
+}
+
+// waiter はキャンセル待ちから取り出したuser。seqは並んだ順で、戻すときに同じ位置に戻す。
+type waiter struct {
+	userID int64
+	seq    float64
+}
+
+// popWaitlist はキャンセル待ちの先頭のuserを取り出す。誰も並んでいなければokはfalse。
+func popWaitlist(eventID int64, rank string) (waiter, bool, error) {
+	if !redisEnabled() {
+		return waiter{}, false, nil
+	}
+	zs, err := client.ZPopMin(waitlistKey(eventID, rank)).Result()
+	if err != nil || len(zs) == 0 {
+		return waiter{}, false, err
+	}
+	userID, _ := strconv.ParseInt(zs[0].Member.(string), 10, 64)
+	client.SRem(userWaitlistsKey(userID), fmt.Sprintf("%v_%v", eventID, rank))
+	return waiter{userID: userID, seq: zs[0].Score}, true, nil
+}
+
+// requeueWaitlist はpopWaitlistで取り出したuserを元の位置に戻す。
+func requeueWaitlist(eventID int64, rank string, w waiter) {
+	if err := client.ZAddNX(waitlistKey(eventID, rank), redis.Z{Score: w.seq, Member: strconv.FormatInt(w.userID, 10)}).Err(); err != nil {
+		log.Println("failed to requeue waitlist:", err)
+		return
+	}
+	client.SAdd(userWaitlistsKey(w.userID), fmt.Sprintf("%v_%v", eventID, rank))
+}
+
+func getWaitlist(eventID int64, rank string) ([]*WaitlistEntry, error) {
+	members, err := client.ZRange(waitlistKey(eventID, rank), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*WaitlistEntry, 0, len(members))
+	for i, member := range members {
+		userID, _ := strconv.ParseInt(member, 10, 64)
+		entries = append(entries, &WaitlistEntry{
+			EventID:   eventID,
+			SheetRank: rank,
+			UserID:    userID,
+			Position:  int64(i + 1),
+		})
+	}
+	return entries, nil
+}
+
+func userWaitlists(userID int64) ([]*WaitlistEntry, error) {
+	if !redisEnabled() {
+		return make([]*WaitlistEntry, 0), nil
+	}
+	members, err := client.SMembers(userWaitlistsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*WaitlistEntry, 0, len(members))
+	for _, member := range members {
+		v := strings.SplitN(member, "_", 2)
+		if len(v) != 2 {
+			continue
+		}
+		eventID, _ := strconv.ParseInt(v[0], 10, 64)
+		pos, err := client.ZRank(waitlistKey(eventID, v[1]), strconv.FormatInt(userID, 10)).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &WaitlistEntry{
+			EventID:   eventID,
+			SheetRank: v[1],
+			Position:  pos + 1,
+		})
+	}
+	return entries, nil
+}
+
+// freeSheets は予約や仮押さえが外れた席をまとめて解放する。
+// キャンセル待ちがいれば先頭のuserから順に仮押さえにして、確定できるようにする。
+// 上限までもう席を持っているuserは飛ばして、位置はそのまま並ばせておく。
+// inventoryの書き換えは一度に行い、失敗したら取り出したuserをキャンセル待ちに戻す。
+func freeSheets(eventID int64, sheets []Sheet) error {
+	type offer struct {
+		sheet  Sheet
+		waiter waiter
+		holdID int64
+	}
+	type skip struct {
+		rank   string
+		waiter waiter
+	}
+	var offers []offer
+	var skipped []skip
+	var freed []Sheet
+	var event *Event
+	offered := make(map[int64][]string)
+	for _, sheet := range sheets {
+		var w waiter
+		found := false
+		for !found {
+			var ok bool
+			var err error
+			w, ok, err = popWaitlist(eventID, sheet.Rank)
+			if err != nil {
+				log.Println("failed to pop waitlist:", err)
+			}
+			if !ok {
+				break
+			}
+			if event == nil {
+				if event, err = getEventBase(context.Background(), eventID); err != nil {
+					log.Println("failed to offer sheet to waitlist:", err)
+					requeueWaitlist(eventID, sheet.Rank, w)
+					break
+				}
+			}
+			ranks := append([]string{sheet.Rank}, offered[w.userID]...)
+			err = checkHoldLimit(context.Background(), event, w.userID, ranks)
+			if err == errLimitExceeded {
+				skipped = append(skipped, skip{rank: sheet.Rank, waiter: w})
+				continue
+			} else if err != nil {
+				log.Println("failed to offer sheet to waitlist:", err)
+				requeueWaitlist(eventID, sheet.Rank, w)
+				break
+			}
+			found = true
+		}
+		if !found {
+			freed = append(freed, sheet)
+			continue
+		}
+		holdID, err := client.Incr(holdIDKey).Result()
+		if err != nil {
+			log.Println("failed to offer sheet to waitlist:", err)
+			requeueWaitlist(eventID, sheet.Rank, w)
+			freed = append(freed, sheet)
+			continue
+		}
+		offers = append(offers, offer{sheet: sheet, waiter: w, holdID: holdID})
+		offered[w.userID] = append(offered[w.userID], sheet.Rank)
+	}
+	for _, s := range skipped {
+		requeueWaitlist(eventID, s.rank, s.waiter)
+	}
+
+	assign := make([]SeatAssignment, 0, len(offers))
+	for _, o := range offers {
+		assign = append(assign, SeatAssignment{Sheet: o.sheet, Value: holdMarker(o.holdID)})
+	}
+	if err := inventory.Update(eventID, freed, assign); err != nil {
+		for _, o := range offers {
+			requeueWaitlist(eventID, o.sheet.Rank, o.waiter)
+		}
+		return err
+	}
+
+	for _, o := range offers {
+		if _, err := saveHold(o.holdID, eventID, o.waiter.userID, o.sheet); err != nil {
+			log.Println("failed to offer sheet to waitlist:", err)
+			requeueWaitlist(eventID, o.sheet.Rank, o.waiter)
+		}
+	}
+	return nil
+}
+
+func postWaitlist(c echo.Context) error {
+	ctx := c.Request().Context()
+	ctx, span := trace.StartSpan(ctx, "postWaitlist")
+	defer span.End()
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank string `json:"sheet_rank"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	event, err := getEvent(ctx, eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.PublicFg {
+		return resError(c, "invalid_event", 404)
+	}
+
+	if !validateRank(event.Venue, params.Rank) {
+		return resError(c, "invalid_rank", 400)
+	}
+
+	n, err := inventory.Count(event.ID, params.Rank)
+	if err != nil {
+		return err
+	}
+	if n < event.Venue.Rank(params.Rank).Num {
+		return resError(c, "not_sold_out", 400)
+	}
+
+	pos, err := joinWaitlist(event.ID, params.Rank, user.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(202, WaitlistEntry{
+		EventID:   event.ID,
+		SheetRank: params.Rank,
+		Position:  pos,
+	})
+}
+
+func deleteWaitlist(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	ok, err := leaveWaitlist(eventID, c.Param("rank"), user.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return resError(c, "not_waiting", 400)
+	}
+	return c.NoContent(204)
+}
+
+func getAdminWaitlist(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	venue, err := venueOfEvent(c.Request().Context(), eventID)
+	if err == sql.ErrNoRows {
+		return resError(c, "not_found", 404)
+	} else if err != nil {
+		return err
+	}
+	waitlists := make(map[string][]*WaitlistEntry)
+	for _, rank := range venue.RankNames() {
+		entries, err := getWaitlist(eventID, rank)
+		if err != nil {
+			return err
+		}
+		waitlists[rank] = entries
+	}
+	return c.JSON(200, waitlists)
+}
+
+func deleteAdminWaitlist(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	ok, err := leaveWaitlist(eventID, c.Param("rank"), userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return resError(c, "not_waiting", 404)
+	}
+	return c.NoContent(204)
+}
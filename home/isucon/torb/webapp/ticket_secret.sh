@@ -0,0 +1,11 @@
+#!/bin/sh
+# チケットの署名に使う鍵がなければ作る。torb.go.serviceの起動前に走る。
+# appを複数台で動かすときは、1台目で作られたticket_secret.envを全台に同じものを置くこと。
+set -ue
+
+SECRET_FILE=$(cd $(dirname $0); pwd)/ticket_secret.env
+
+if [ ! -s "$SECRET_FILE" ]; then
+  umask 077
+  printf 'TICKET_SECRET=%s\n' "$(head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n')" > "$SECRET_FILE"
+fi